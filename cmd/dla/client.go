@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// tlsFiles are the certificate paths given on the command line.
+type tlsFiles struct {
+	enabled bool
+	cert    string
+	key     string
+	ca      string
+}
+
+// requested reports whether any TLS flag was given.
+func (tf tlsFiles) requested() bool {
+	return tf.enabled || tf.cert != "" || tf.key != "" || tf.ca != ""
+}
+
+// newClient connects to the daemon at host, or the one described by the
+// DOCKER_* environment when host is empty, and checks it is reachable.
+func newClient(host string, tf tlsFiles) (*docker.Client, error) {
+	client, err := dialClient(host, tf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(); err != nil {
+		if host == "" {
+			host = os.Getenv("DOCKER_HOST")
+		}
+		return nil, fmt.Errorf("unable to reach docker at %q: %s", host, err)
+	}
+
+	return client, nil
+}
+
+// serverAPIVersion asks the daemon which API version it speaks, nil when it
+// cannot tell.
+func serverAPIVersion(client *docker.Client) docker.APIVersion {
+	env, err := client.Version()
+	if err != nil || env == nil {
+		return nil
+	}
+
+	version, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return nil
+	}
+	return version
+}
+
+func dialClient(host string, tf tlsFiles) (*docker.Client, error) {
+	if tf.requested() {
+		return dialTLSClient(host, tf)
+	}
+
+	if host == "" {
+		return docker.NewClientFromEnv()
+	}
+
+	if err := validateHost(host); err != nil {
+		return nil, err
+	}
+
+	// honor the same TLS settings NewClientFromEnv would
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" && os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		return docker.NewTLSClient(host,
+			filepath.Join(certPath, "cert.pem"),
+			filepath.Join(certPath, "key.pem"),
+			filepath.Join(certPath, "ca.pem"),
+		)
+	}
+
+	return docker.NewClient(host)
+}
+
+// dialTLSClient connects over TLS with the certificates of tf, falling back
+// to those in DOCKER_CERT_PATH (or ~/.docker) for any not given.
+func dialTLSClient(host string, tf tlsFiles) (*docker.Client, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		return nil, fmt.Errorf("TLS requires a docker host, set -H or DOCKER_HOST")
+	}
+	if err := validateHost(host); err != nil {
+		return nil, err
+	}
+
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+
+	files := []struct {
+		flag string
+		path *string
+		name string
+	}{
+		{"-tlscert", &tf.cert, "cert.pem"},
+		{"-tlskey", &tf.key, "key.pem"},
+		{"-tlscacert", &tf.ca, "ca.pem"},
+	}
+	for _, f := range files {
+		if *f.path != "" {
+			if _, err := os.Stat(*f.path); err != nil {
+				return nil, fmt.Errorf("%s file %q: %s", f.flag, *f.path, err)
+			}
+			continue
+		}
+
+		// defaults are optional, a daemon may not require client certificates
+		if certPath == "" {
+			continue
+		}
+		if def := filepath.Join(certPath, f.name); fileExists(def) {
+			*f.path = def
+		}
+	}
+
+	if (tf.cert == "") != (tf.key == "") {
+		return nil, fmt.Errorf("a TLS client certificate requires both -tlscert and -tlskey")
+	}
+
+	if version := os.Getenv("DOCKER_API_VERSION"); version != "" {
+		return docker.NewVersionedTLSClient(host, tf.cert, tf.key, tf.ca, version)
+	}
+	return docker.NewTLSClient(host, tf.cert, tf.key, tf.ca)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// validateHost checks host is a URL docker can be dialed at.
+func validateHost(host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid docker host %q: %s", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix", "npipe":
+		if u.Path == "" {
+			return fmt.Errorf("invalid docker host %q: missing socket path", host)
+		}
+	case "tcp", "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("invalid docker host %q: missing address", host)
+		}
+	default:
+		return fmt.Errorf("invalid docker host %q: expected a unix://, npipe://, tcp://, http:// or https:// URL", host)
+	}
+
+	return nil
+}
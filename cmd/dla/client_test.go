@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dockerEnv clears the DOCKER_* environment the client is built from, setting
+// DOCKER_HOST to host.
+func dockerEnv(t *testing.T, host string) {
+	t.Helper()
+	t.Setenv("DOCKER_HOST", host)
+	t.Setenv("DOCKER_CERT_PATH", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_API_VERSION", "")
+}
+
+func TestDialClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		want    string
+		wantErr string
+	}{
+		{name: "flag over environment", host: "tcp://flag:2375", want: "tcp://flag:2375"},
+		{name: "environment", want: "tcp://env:2375"},
+		{name: "unix socket", host: "unix:///var/run/docker.sock", want: "unix:///var/run/docker.sock"},
+		{name: "missing scheme", host: "flag:2375", wantErr: `invalid docker host "flag:2375": expected a unix://`},
+		{name: "missing address", host: "tcp://", wantErr: `invalid docker host "tcp://": missing address`},
+		{name: "missing socket", host: "unix://", wantErr: `invalid docker host "unix://": missing socket path`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerEnv(t, "tcp://env:2375")
+
+			client, err := dialClient(tt.host, tlsFiles{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialClient() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialClient() error = %v", err)
+			}
+			if got := client.Endpoint(); got != tt.want {
+				t.Errorf("dialClient() endpoint = %q, want %q", got, tt.want)
+			}
+			if client.TLSConfig != nil {
+				t.Errorf("dialClient() connects over TLS, want plain")
+			}
+		})
+	}
+}
+
+func TestDialTLSClient(t *testing.T) {
+	certs := t.TempDir()
+	missing := filepath.Join(certs, "missing.pem")
+	key := filepath.Join(certs, "key.pem")
+	if err := os.WriteFile(key, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		env     string
+		tf      tlsFiles
+		wantTLS bool
+		wantErr string
+	}{
+		{name: "no flags", host: "tcp://flag:2376"},
+		{name: "tls", host: "tcp://flag:2376", tf: tlsFiles{enabled: true}, wantTLS: true},
+		{name: "tls on the environment host", env: "tcp://env:2376", tf: tlsFiles{enabled: true}, wantTLS: true},
+		{name: "tls without a host", tf: tlsFiles{enabled: true}, wantErr: "TLS requires a docker host"},
+		{name: "missing cert", host: "tcp://flag:2376", tf: tlsFiles{cert: missing}, wantErr: `-tlscert file "` + missing + `"`},
+		{name: "missing ca", host: "tcp://flag:2376", tf: tlsFiles{ca: missing}, wantErr: `-tlscacert file "` + missing + `"`},
+		{name: "key without cert", host: "tcp://flag:2376", tf: tlsFiles{key: key}, wantErr: "requires both -tlscert and -tlskey"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerEnv(t, tt.env)
+			// an empty directory, so no default certificate is picked up
+			t.Setenv("DOCKER_CERT_PATH", t.TempDir())
+
+			client, err := dialClient(tt.host, tt.tf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialClient() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialClient() error = %v", err)
+			}
+			if gotTLS := client.TLSConfig != nil; gotTLS != tt.wantTLS {
+				t.Errorf("dialClient() TLS = %v, want %v", gotTLS, tt.wantTLS)
+			}
+		})
+	}
+}
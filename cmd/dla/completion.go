@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// hiddenFlags are left out of the usage message, they exist for the
+// completion scripts rather than for people.
+var hiddenFlags = map[string]struct{}{
+	"completion":    {},
+	"list-services": {},
+}
+
+// flagValues are the fixed choices completed for flags taking one.
+var flagValues = map[string]string{
+	"o":               strings.Join(outputChoices, " "),
+	"tcp-format":      strings.Join(tcpFormatChoices, " "),
+	"align":           strings.Join(alignChoices, " "),
+	"prefix-position": strings.Join(positionChoices, " "),
+	"seq-position":    strings.Join(positionChoices, " "),
+	"color-by":        strings.Join(colorByChoices, " "),
+	"match":           strings.Join(matchChoices, " "),
+	"status":          "created restarting running removing paused exited dead",
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+// usage is flag's default usage message without the hidden flags.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", progName())
+
+	visible := flag.NewFlagSet(progName(), flag.ContinueOnError)
+	visible.SetOutput(flag.CommandLine.Output())
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := hiddenFlags[f.Name]; !ok {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// completionFlags lists the visible flags, dash prefixed.
+func completionFlags() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := hiddenFlags[f.Name]; !ok {
+			names = append(names, "-"+f.Name)
+		}
+	})
+	return names
+}
+
+// writeCompletion writes the completion script for shell to w. Service names
+// are completed by calling back into the program with -list-services.
+func writeCompletion(w io.Writer, shell string) error {
+	prog := progName()
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+	flags := strings.Join(completionFlags(), " ")
+
+	values := make([]string, 0, len(flagValues))
+	for name := range flagValues {
+		values = append(values, name)
+	}
+	sort.Strings(values)
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, "# bash completion for %s\n", prog)
+		fmt.Fprintf(w, "%s() {\n", fn)
+		fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+		fmt.Fprintf(w, "\tcase \"$prev\" in\n")
+		for _, name := range values {
+			fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", name, flagValues[name])
+		}
+		fmt.Fprintf(w, "\tesac\n")
+		fmt.Fprintf(w, "\tif [[ \"$cur\" == -* ]]; then\n")
+		fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", flags)
+		fmt.Fprintf(w, "\t\treturn\n")
+		fmt.Fprintf(w, "\tfi\n")
+		fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"$(%s -list-services 2>/dev/null)\" -- \"$cur\"))\n", prog)
+		fmt.Fprintf(w, "}\n")
+		fmt.Fprintf(w, "complete -F %s %s\n", fn, prog)
+
+	case "zsh":
+		fmt.Fprintf(w, "#compdef %s\n", prog)
+		fmt.Fprintf(w, "%s() {\n", fn)
+		fmt.Fprintf(w, "\tcase \"${words[CURRENT-1]}\" in\n")
+		for _, name := range values {
+			fmt.Fprintf(w, "\t-%s) compadd -- %s; return ;;\n", name, flagValues[name])
+		}
+		fmt.Fprintf(w, "\tesac\n")
+		fmt.Fprintf(w, "\tif [[ \"$PREFIX\" == -* ]]; then\n")
+		fmt.Fprintf(w, "\t\tcompadd -- %s\n", flags)
+		fmt.Fprintf(w, "\t\treturn\n")
+		fmt.Fprintf(w, "\tfi\n")
+		fmt.Fprintf(w, "\tcompadd -- ${(f)\"$(%s -list-services 2>/dev/null)\"}\n", prog)
+		fmt.Fprintf(w, "}\n")
+		fmt.Fprintf(w, "compdef %s %s\n", fn, prog)
+
+	default:
+		return fmt.Errorf("unsupported shell %q: expected bash or zsh", shell)
+	}
+
+	return nil
+}
+
+// listServices writes the sorted swarm, or with compose docker compose,
+// service names of the running containers to w, one per line.
+func listServices(w io.Writer, client *docker.Client, compose bool) error {
+	conts, err := client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+
+	key := "com.docker.swarm.service.name"
+	if compose {
+		key = "com.docker.compose.service"
+	}
+
+	found := map[string]struct{}{}
+	for _, cont := range conts {
+		if name := cont.Labels[key]; name != "" {
+			found[name] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+
+	return nil
+}
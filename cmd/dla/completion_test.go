@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagValuesParse(t *testing.T) {
+	// the flags some choices need set with them
+	needs := map[string]func(f *flgs){
+		"o=tcp":      func(f *flgs) { f.addr = "localhost:5000" },
+		"tcp-format": func(f *flgs) { f.output, f.addr = outputTCP, "localhost:5000" },
+	}
+
+	saved := flags
+	defer func() { flags = saved }()
+
+	for name, values := range flagValues {
+		for _, value := range strings.Fields(values) {
+			t.Run(name+"="+value, func(t *testing.T) {
+				flags = saved
+				if err := flag.CommandLine.Set(name, value); err != nil {
+					t.Fatalf("setting -%s: %v", name, err)
+				}
+				for _, key := range []string{name, name + "=" + value} {
+					if need, ok := needs[key]; ok {
+						need(&flags)
+					}
+				}
+				if err := flags.parse(time.Now()); err != nil {
+					t.Errorf("parse() error = %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		t.Run(shell, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeCompletion(&b, shell); err != nil {
+				t.Fatalf("writeCompletion() error = %v", err)
+			}
+			script := b.String()
+			for name, values := range flagValues {
+				if !strings.Contains(script, values) {
+					t.Errorf("script missing the -%s values %q", name, values)
+				}
+			}
+			if strings.Contains(script, "-completion") {
+				t.Errorf("script completes the hidden -completion flag")
+			}
+		})
+	}
+
+	if err := writeCompletion(&bytes.Buffer{}, "fish"); err == nil {
+		t.Errorf("writeCompletion(fish) error = nil, want unsupported shell")
+	}
+}
+
+func TestFlagValuesOutputs(t *testing.T) {
+	completed := strings.Fields(flagValues["o"])
+	for _, output := range []string{"text", "json", "logfmt", "syslog", "tcp"} {
+		found := false
+		for _, value := range completed {
+			found = found || value == output
+		}
+		if !found {
+			t.Errorf("-o completes %q, missing %s", completed, output)
+		}
+	}
+}
+
+func TestCheckChoice(t *testing.T) {
+	tests := []struct {
+		value   string
+		choices []string
+		wantErr string
+	}{
+		{value: "left", choices: alignChoices},
+		{value: "center", choices: alignChoices, wantErr: `invalid -x value "center": expected left or right`},
+		{value: "xml", choices: outputChoices, wantErr: `invalid -x value "xml": expected text, json, logfmt, syslog or tcp`},
+		{value: "", choices: matchChoices, wantErr: `invalid -x value "": expected any or all`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := checkChoice("x", tt.value, tt.choices)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkChoice() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("checkChoice() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfigName is the file in the home directory flag defaults are read
+// from when -config is not given.
+const defaultConfigName = ".dla.conf"
+
+// loadConfig applies the flag defaults in the config file at path, or the
+// default file when path is empty, to fset. Flags set on the command line,
+// or an alias of one, are left alone so they override the file.
+//
+// The file holds one flag per line as name=value, or just name for boolean
+// flags, with blank lines and lines starting with # ignored. Repeatable flags
+// may be given more than once.
+func loadConfig(fset *flag.FlagSet, path string) error {
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, defaultConfigName)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	// aliases such as -q and -quiet share their Value
+	set := map[flag.Value]bool{}
+	fset.Visit(func(f *flag.Flag) {
+		set[f.Value] = true
+	})
+
+	scan := bufio.NewScanner(file)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		value = strings.TrimSpace(value)
+
+		f := fset.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", path, n, name)
+		}
+		if set[f.Value] {
+			continue
+		}
+		if !hasValue {
+			if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !bf.IsBoolFlag() {
+				return fmt.Errorf("%s:%d: flag %q needs a value", path, n, name)
+			}
+			value = "true"
+		}
+		if err := fset.Set(f.Name, value); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+
+	return scan.Err()
+}
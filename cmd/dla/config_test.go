@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configFlags is a flag set with a boolean, a string, an aliased and a
+// repeatable flag, parsed from args.
+func configFlags(t *testing.T, args ...string) (fset *flag.FlagSet, follow *bool, tail *string, quiet *bool, labels *stringsFlag) {
+	t.Helper()
+
+	fset = flag.NewFlagSet("dla", flag.ContinueOnError)
+	follow = fset.Bool("f", false, "")
+	tail = fset.String("t", "all", "")
+	quiet = fset.Bool("q", false, "")
+	fset.BoolVar(quiet, "quiet", false, "")
+	labels = &stringsFlag{}
+	fset.Var(labels, "label", "")
+	if err := fset.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fset, follow, tail, quiet, labels
+}
+
+// writeConfig writes content to a config file, returning its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), defaultConfigName)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, "# defaults\nf\n\n-t = 100\nquiet=true\nlabel=env=prod\nlabel=tier=web\n")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantFollow bool
+		wantTail   string
+		wantQuiet  bool
+		wantLabels stringsFlag
+	}{
+		{
+			name:       "file values apply",
+			wantFollow: true,
+			wantTail:   "100",
+			wantQuiet:  true,
+			wantLabels: stringsFlag{"env=prod", "tier=web"},
+		},
+		{
+			name:       "explicit flags override them",
+			args:       []string{"-f=false", "-t", "5", "-q=false", "-label", "env=dev"},
+			wantTail:   "5",
+			wantLabels: stringsFlag{"env=dev"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset, follow, tail, quiet, labels := configFlags(t, tt.args...)
+			if err := loadConfig(fset, path); err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if *follow != tt.wantFollow || *tail != tt.wantTail || *quiet != tt.wantQuiet {
+				t.Errorf("f = %v, t = %q, quiet = %v, want %v, %q, %v", *follow, *tail, *quiet, tt.wantFollow, tt.wantTail, tt.wantQuiet)
+			}
+			if !reflect.DeepEqual(*labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", *labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown flag", content: "colour=red\n", wantErr: `:1: unknown flag "colour"`},
+		{name: "missing value", content: "f\nt\n", wantErr: `:2: flag "t" needs a value`},
+		{name: "bad value", content: "f=maybe\n", wantErr: ":1: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset, _, _, _, _ := configFlags(t)
+			err := loadConfig(fset, writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		fset, _, _, _, _ := configFlags(t)
+		if err := loadConfig(fset, filepath.Join(t.TempDir(), "nope")); err == nil {
+			t.Error("loadConfig() of a missing -config file succeeded, want an error")
+		}
+	})
+
+	t.Run("no default file", func(t *testing.T) {
+		t.Setenv("HOME", t.TempDir())
+		fset, _, _, _, _ := configFlags(t)
+		if err := loadConfig(fset, ""); err != nil {
+			t.Errorf("loadConfig() without a default file error = %v", err)
+		}
+	})
+}
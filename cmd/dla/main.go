@@ -2,278 +2,1064 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"sort"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/Morgahl/dockerutils/dla"
 	"github.com/fatih/color"
 	"github.com/fsouza/go-dockerclient"
 )
 
 type flgs struct {
-	follow bool
-	tail   string
+	follow      bool
+	tail        string
+	since       string
+	until       string
+	sinceStart  bool
+	ts          bool
+	utc         bool
+	tz          string
+	timeFormat  string
+	details     bool
+	noColor     bool
+	output      string
+	syslogAddr  string
+	addr        string
+	tcpFormat   string
+	serve       bool
+	raw         bool
+	list        bool
+	stdin       bool
+	config      string
+	images      stringsFlag
+	containers  stringsFlag
+	networks    stringsFlag
+	exclude     stringsFlag
+	labels      stringsFlag
+	match       string
+	status      string
+	regex       bool
+	glob        bool
+	compose     bool
+	tagLabel    string
+	grep        string
+	grepV       string
+	expr        string
+	noHealth    bool
+	healthRE    string
+	maxLine     int
+	keepCR      bool
+	reconnect   int
+	watch       bool
+	serviceLogs bool
+	refresh     time.Duration
+	buffer      int
+	drop        bool
+	concurrency int
+	host        string
+	tls         tlsFiles
+	quiet       bool
+	colorBy     string
+	colors      string
+	stderrColor string
+	sep         string
+	align       string
+	position    string
+	seq         bool
+	seqPosition string
+	maxTag      int
+	showID      bool
+	showNode    bool
+	template    string
+	out         string
+	outStderr   bool
+	gzip        bool
+	rotateSize  string
+	rotateKeep  int
+	rotateBytes int64
+	errOut      string
+	stdoutOnly  bool
+	stderrOnly  bool
+	merge       bool
+	stripANSI   bool
+	rate        float64
+	dedupe      bool
+	multiline   string
+	completion  string
+	listSvcs    bool
+	connTimeout time.Duration
+	maxDuration time.Duration
+	exitGrace   time.Duration
+	eofGrace    time.Duration
+	maxLines    int
+	head        int
+	retries     int
+
+	// derived from the raw flag values by parse
+	format    dla.Format
+	loc       *time.Location
+	layout    string
+	sinceUnix int64
+	untilUnix int64
+	statuses  []string
+	palette   []*color.Color
+	errColor  *color.Color
+	tmpl      *template.Template
+	filter    *dla.LineFilter
+	multiRE   *regexp.Regexp
 }
 
 var flags = flgs{}
 
 func init() {
-	flag.BoolVar(&flags.follow, "f", false, "Follow log output")
-	flag.StringVar(&flags.tail, "t", "", "Tail size of log output")
+	flag.BoolVar(&flags.follow, "f", false, "Follow log output, after the history selected by -t and -since")
+	flag.StringVar(&flags.tail, "t", "", "Number of lines to show from the end of the logs, or all, before following with -f")
+	flag.StringVar(&flags.since, "since", "", "Show logs since a duration ago (e.g. 10m) or an RFC3339 timestamp")
+	flag.BoolVar(&flags.sinceStart, "since-start", false, "Show each container's logs since it last started, falling back to -since")
+	flag.StringVar(&flags.until, "until", "", "Show logs until a duration ago (e.g. 10m) or an RFC3339 timestamp")
+	flag.BoolVar(&flags.ts, "ts", false, "Prefix each line with the time docker recorded it")
+	flag.BoolVar(&flags.utc, "utc", false, "Render -ts timestamps in UTC rather than local time, same as -tz UTC")
+	flag.StringVar(&flags.timeFormat, "time-format", "15:04:05.000", "Layout of -ts timestamps: a Go time layout, kitchen, rfc3339, epoch or epoch-ms")
+	flag.StringVar(&flags.tz, "tz", "", "Time zone -ts timestamps are rendered in: Local, UTC or a name like America/New_York")
+	flag.BoolVar(&flags.details, "details", false, "Show the extra details, such as labels or env, docker's log driver records with each line, with -service")
+	flag.BoolVar(&flags.noColor, "no-color", false, "Disable colored output")
+	flag.StringVar(&flags.output, "o", string(dla.FormatText), "Output format: text, json, logfmt, syslog or tcp")
+	flag.StringVar(&flags.syslogAddr, "syslog-addr", "", "Remote syslog daemon for -o syslog (e.g. udp://host:514), defaults to the local one")
+	flag.StringVar(&flags.addr, "addr", "", "Log collector host:port that -o tcp sends lines to, or the address serve listens on")
+	flag.StringVar(&flags.tcpFormat, "tcp-format", string(dla.FormatJSON), "Format of the lines -o tcp sends: text, json or logfmt")
+	flag.BoolVar(&flags.raw, "raw", false, "Copy container output through untouched, without tags, colors or line handling")
+	flag.StringVar(&flags.config, "config", "", "File of flag defaults, one name=value per line, defaults to ~/"+defaultConfigName)
+	flag.BoolVar(&flags.list, "list", false, "List the containers that would be streamed and exit")
+	flag.BoolVar(&flags.stdin, "stdin", false, "Read service names to stream from stdin, one per line, along with any arguments")
+	flag.Var(&flags.images, "image", "Select containers running an image (repeatable)")
+	flag.Var(&flags.containers, "name", "Select a container by its name or ID (repeatable)")
+	flag.Var(&flags.networks, "network", "Select containers attached to a network by name or ID (repeatable)")
+	flag.Var(&flags.exclude, "exclude", "Drop containers whose service, tag or name matches a glob such as web* (repeatable)")
+	flag.StringVar(&flags.match, "match", string(dla.MatchAny), "Stream containers matching any or all of the selections")
+	flag.Var(&flags.labels, "label", "Select containers with a key=value label, all given must match (repeatable)")
+	flag.BoolVar(&flags.regex, "regex", false, "Match service name arguments as regular expressions against the full name")
+	flag.StringVar(&flags.expr, "filter", "", "Select containers by an expression over service, name, image, status and label.<key>, such as 'service=web and not label.env=dev'")
+	flag.BoolVar(&flags.glob, "glob", false, "Match service name arguments as shell globs such as web* or api-?")
+	flag.StringVar(&flags.tagLabel, "tag-label", "", "Name containers by the value of this label, for those carrying it")
+	flag.BoolVar(&flags.compose, "compose", false, "Select docker compose services by name rather than swarm services")
+	flag.StringVar(&flags.grep, "grep", "", "Only print lines matching a regular expression")
+	flag.StringVar(&flags.grepV, "grep-v", "", "Do not print lines matching a regular expression")
+	flag.BoolVar(&flags.noHealth, "no-healthcheck", false, "Do not print lines that look like healthcheck probes, see -healthcheck-pattern")
+	flag.StringVar(&flags.healthRE, "healthcheck-pattern", dla.HealthcheckPattern, "Regular expression matching the lines -no-healthcheck drops")
+	flag.IntVar(&flags.maxLine, "max-line", 1<<20, "Longest line in bytes printed before truncating")
+	flag.BoolVar(&flags.keepCR, "keep-cr", false, "Preserve carriage returns and original line terminators")
+	flag.IntVar(&flags.reconnect, "reconnect", 5, "Attempts to reattach a dropped stream while following")
+	flag.BoolVar(&flags.watch, "watch", false, "Attach to matching containers started while following")
+	flag.BoolVar(&flags.serviceLogs, "service", false, "Stream each swarm service as one through docker's service logs, covering tasks on every node")
+	flag.DurationVar(&flags.refresh, "refresh", 0, "Re-resolve containers this often while following (e.g. 10s), 0 to disable")
+	flag.IntVar(&flags.buffer, "buffer", 0, "Lines queued per container stream ahead of the output, 0 to write directly")
+	flag.BoolVar(&flags.drop, "drop", false, "Drop the oldest queued lines when the output falls behind (requires -buffer)")
+	flag.IntVar(&flags.concurrency, "concurrency", 0, "Maximum number of concurrent docker requests, 0 for no limit")
+	flag.StringVar(&flags.host, "H", "", "Docker daemon to connect to, defaults to $DOCKER_HOST")
+	flag.StringVar(&flags.host, "host", "", "Docker daemon to connect to, defaults to $DOCKER_HOST")
+	flag.BoolVar(&flags.tls.enabled, "tls", false, "Connect to the docker daemon over TLS")
+	flag.StringVar(&flags.tls.cert, "tlscert", "", "Path to the TLS client certificate")
+	flag.StringVar(&flags.tls.key, "tlskey", "", "Path to the TLS client key")
+	flag.StringVar(&flags.tls.ca, "tlscacert", "", "Path to the CA certificate used to verify the daemon")
+	flag.BoolVar(&flags.quiet, "q", false, "Suppress informational messages and the exit summary")
+	flag.BoolVar(&flags.quiet, "quiet", false, "Suppress informational messages and the exit summary")
+	flag.StringVar(&flags.colorBy, "color-by", string(dla.ColorByContainer), "Color tags by container (stable hash), index or stream")
+	flag.StringVar(&flags.colors, "colors", "", "Comma separated tag colors, names like red or hi-blue or 256 color codes")
+	flag.StringVar(&flags.stderrColor, "stderr-color", "", "Color of stderr lines as a color and attributes joined by +, such as bold+yellow (default hi-red)")
+	flag.StringVar(&flags.sep, "sep", dla.DefaultSeparator, "Separator between the tag and the log line")
+	flag.StringVar(&flags.align, "align", string(dla.AlignLeft), "Align tags left or right")
+	flag.StringVar(&flags.position, "prefix-position", string(dla.PositionBefore), "Write tags before or after the message")
+	flag.BoolVar(&flags.seq, "seq", false, "Number every line in the order written, across all containers")
+	flag.StringVar(&flags.seqPosition, "seq-position", string(dla.PositionBefore), "Write -seq numbers before or after the tag")
+	flag.IntVar(&flags.maxTag, "max-tag", 0, "Cut tags longer than this many characters short, 0 for no limit")
+	flag.BoolVar(&flags.showID, "show-id", false, "Add the short container ID to each tag")
+	flag.BoolVar(&flags.showNode, "show-node", false, "Add the swarm node a task runs on to each tag")
+	flag.StringVar(&flags.template, "template", "", "Go template for line prefixes, e.g. '{{.Service}} {{.ID}} {{.Time}} '")
+	flag.StringVar(&flags.out, "out", "", "Append log lines to a file instead of stdout")
+	flag.BoolVar(&flags.outStderr, "out-stderr", true, "Also write stderr lines to the -out file rather than the terminal")
+	flag.StringVar(&flags.errOut, "err-out", "", "Append stderr lines to a file, separately from -out")
+	flag.BoolVar(&flags.gzip, "gzip", false, "Gzip the -out and -err-out files")
+	flag.StringVar(&flags.rotateSize, "rotate-size", "", "Start a new -out or -err-out file once one reaches this size (e.g. 100MB), moving the old one aside")
+	flag.IntVar(&flags.rotateKeep, "rotate-keep", 0, "Rotated files to keep for each output file, 0 keeps them all")
+	flag.BoolVar(&flags.stdoutOnly, "stdout-only", false, "Only stream containers' stdout")
+	flag.BoolVar(&flags.stderrOnly, "stderr-only", false, "Only stream containers' stderr")
+	flag.BoolVar(&flags.merge, "merge", false, "Print lines in timestamp order across containers, delaying each briefly (requires -ts)")
+	flag.BoolVar(&flags.stripANSI, "strip-ansi", false, "Remove ANSI escape sequences from container output")
+	flag.DurationVar(&flags.connTimeout, "connect-timeout", 30*time.Second, "How long to wait for docker to list the containers, 0 for no limit")
+	flag.IntVar(&flags.retries, "connect-retries", 0, "Times to retry connecting to docker and listing the containers when that fails")
+	flag.DurationVar(&flags.maxDuration, "max-duration", 0, "Stop streaming after this long (e.g. 30m), 0 for no limit")
+	flag.DurationVar(&flags.exitGrace, "exit-grace", 0, "Keep streams open this long once stopped (e.g. 500ms), so lines docker already sent are written")
+	flag.DurationVar(&flags.eofGrace, "no-follow-exit-grace", 0, "Without -f, keep reading running containers until their logs have been quiet this long (e.g. 200ms), so lines docker had yet to flush are written")
+	flag.IntVar(&flags.maxLines, "max-lines", 0, "Stop streaming once this many lines have been printed in total, 0 for no limit")
+	flag.IntVar(&flags.head, "head", 0, "Print only the first N lines of each container, then stop its stream (see -max-lines for a limit across all of them)")
+	flag.Float64Var(&flags.rate, "rate", 0, "Maximum lines a second printed per container stream, 0 for no limit")
+	flag.BoolVar(&flags.dedupe, "dedupe", false, "Collapse consecutive identical lines from a container stream")
+	flag.StringVar(&flags.multiline, "multiline", "", "Regular expression matching the first line of a record, other lines are joined onto the record before them")
+	flag.StringVar(&flags.completion, "completion", "", "Print the completion script for bash or zsh")
+	flag.BoolVar(&flags.listSvcs, "list-services", false, "List the running swarm services, or compose services with -compose, for completion")
+	flag.StringVar(&flags.status, "status", "", "Comma separated container states to select (e.g. running,exited)")
 }
 
-const (
-	swarmServiceNameKey = "com.docker.swarm.service.name"
-	swarmTaskNameKey    = "com.docker.swarm.task.name"
-)
+// outputTCP is the -o value sending lines to a collector rather than a
+// format of its own, -tcp-format picks the lines' format.
+const outputTCP = "tcp"
 
-func main() {
-	flag.Parse()
+// The values of the flags choosing from a fixed set, which parse accepts and
+// the completion scripts offer.
+var (
+	outputChoices    = []string{string(dla.FormatText), string(dla.FormatJSON), string(dla.FormatLogfmt), string(dla.FormatSyslog), outputTCP}
+	tcpFormatChoices = []string{string(dla.FormatText), string(dla.FormatJSON), string(dla.FormatLogfmt)}
+	alignChoices     = []string{string(dla.AlignLeft), string(dla.AlignRight)}
+	positionChoices  = []string{string(dla.PositionBefore), string(dla.PositionAfter)}
+	matchChoices     = []string{string(dla.MatchAny), string(dla.MatchAll)}
+	colorByChoices   = []string{string(dla.ColorByContainer), string(dla.ColorByIndex), string(dla.ColorByStream)}
+)
 
-	client, err := docker.NewClientFromEnv()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to setup connection to docker: %s\n", err)
-		os.Exit(1)
+// checkChoice reports value as invalid for the flag name unless it is one of
+// choices.
+func checkChoice(name, value string, choices []string) error {
+	for _, choice := range choices {
+		if value == choice {
+			return nil
+		}
 	}
 
-	conts, err := getContainersByNames(client, flag.Args())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error retrieving container information: %s\n", err)
-		os.Exit(1)
-	} else if len(conts) <= 0 {
-		fmt.Println("No services meet the criteria")
-		return
-	}
+	expected := strings.Join(choices[:len(choices)-1], ", ") + " or " + choices[len(choices)-1]
+	return fmt.Errorf("invalid -%s value %q: expected %s", name, value, expected)
+}
+
+// stringsFlag collects every occurrence of a repeatable flag.
+type stringsFlag []string
 
-	logContainers(client, conts)
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
 }
 
-func getContainersByNames(client *docker.Client, names []string) ([]docker.APIContainers, error) {
-	conts := make([]docker.APIContainers, 0, len(names))
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
 
-	switch len(names) {
-	case 0:
-		return getAllContainers(client)
+// parse validates the raw flag values and fills in the derived fields.
+func (f *flgs) parse(now time.Time) error {
+	if f.serviceLogs && f.raw {
+		return fmt.Errorf("-service cannot be used with -raw, lines are split to tag them by task")
+	}
+	if f.serviceLogs && f.until != "" {
+		return fmt.Errorf("-until cannot be used with -service, service logs cannot be bounded")
+	}
+	if f.details && !f.serviceLogs {
+		return fmt.Errorf("-details requires -service, only service logs carry details")
+	}
+	if f.watch && !f.follow {
+		return fmt.Errorf("-watch requires -f")
+	}
+	if f.refresh != 0 && !f.follow {
+		return fmt.Errorf("-refresh requires -f")
+	}
+	if f.buffer < 0 {
+		return fmt.Errorf("invalid -buffer value %d: must not be negative", f.buffer)
+	}
+	if f.drop && f.buffer == 0 {
+		return fmt.Errorf("-drop requires -buffer")
+	}
+	if f.refresh < 0 {
+		return fmt.Errorf("invalid -refresh value %s: must not be negative", f.refresh)
+	}
+	if f.maxDuration < 0 {
+		return fmt.Errorf("invalid -max-duration value %s: must not be negative", f.maxDuration)
+	}
+	if f.exitGrace < 0 {
+		return fmt.Errorf("invalid -exit-grace value %s: must not be negative", f.exitGrace)
+	}
+	if f.eofGrace < 0 {
+		return fmt.Errorf("invalid -no-follow-exit-grace value %s: must not be negative", f.eofGrace)
+	}
+	if f.eofGrace != 0 && f.follow {
+		return fmt.Errorf("-no-follow-exit-grace cannot be used with -f, which reads past the end already")
+	}
+	if f.retries < 0 {
+		return fmt.Errorf("invalid -connect-retries value %d: must not be negative", f.retries)
+	}
+	if f.maxLines < 0 {
+		return fmt.Errorf("invalid -max-lines value %d: must not be negative", f.maxLines)
+	}
+	if f.maxLines > 0 && f.raw {
+		return fmt.Errorf("-max-lines cannot be used with -raw, raw output is not split into lines")
+	}
+	if f.head < 0 {
+		return fmt.Errorf("invalid -head value %d: must not be negative", f.head)
+	}
+	if f.head > 0 && f.raw {
+		return fmt.Errorf("-head cannot be used with -raw, raw output is not split into lines")
+	}
+	if f.head > 0 && f.follow {
+		return fmt.Errorf("-head cannot be used with -f, it takes the first lines of logs that end")
+	}
 
+	if f.merge && !f.ts {
+		return fmt.Errorf("-merge requires -ts")
+	}
+
+	if f.stdoutOnly && f.stderrOnly {
+		return fmt.Errorf("-stdout-only and -stderr-only are mutually exclusive")
+	}
+
+	if f.rate < 0 {
+		return fmt.Errorf("invalid -rate value %v: must not be negative", f.rate)
+	}
+
+	switch f.tail {
+	case "", "all":
+		f.tail = "all"
 	default:
-		type contr struct {
-			conts []docker.APIContainers
-			err   error
+		if n, err := strconv.Atoi(f.tail); err != nil || n < 0 {
+			return fmt.Errorf("invalid -t value %q: expected a non-negative number of lines or all", f.tail)
 		}
-		ch := make(chan contr, len(names))
-		wg := sync.WaitGroup{}
-		wg.Add(len(names))
-		for _, name := range names {
-			go func(name string) {
-				defer wg.Done()
-				iconts, err := getContainerForName(client, name)
-				ch <- contr{
-					conts: iconts,
-					err:   err,
-				}
-			}(name)
-		}
-
-		wg.Wait()
-		close(ch)
-
-		for contr := range ch {
-			if contr.err != nil {
-				return nil, contr.err
+	}
+
+	if err := checkChoice("o", f.output, outputChoices); err != nil {
+		return err
+	}
+	f.format = dla.Format(f.output)
+	if f.output == outputTCP {
+		if f.addr == "" {
+			return fmt.Errorf("-o %s requires -addr", outputTCP)
+		}
+		if err := checkChoice("tcp-format", f.tcpFormat, tcpFormatChoices); err != nil {
+			return err
+		}
+		f.format = dla.Format(f.tcpFormat)
+	}
+
+	if f.raw && f.format != dla.FormatText {
+		return fmt.Errorf("-raw cannot be used with -o %s", f.output)
+	}
+	if f.raw && f.until != "" {
+		return fmt.Errorf("-until cannot be used with -raw, raw output is not split into lines")
+	}
+
+	if f.serve {
+		if f.addr == "" {
+			return fmt.Errorf("serve requires -addr")
+		}
+		if f.format != dla.FormatText && f.format != dla.FormatJSON {
+			return fmt.Errorf("serve sends %s events, -o %s cannot be used", dla.FormatJSON, f.output)
+		}
+		if f.out != "" || f.errOut != "" {
+			return fmt.Errorf("-out and -err-out cannot be used with serve")
+		}
+		f.format = dla.FormatJSON
+		f.follow = true
+	}
+
+	if (f.output == string(dla.FormatSyslog) || f.output == outputTCP) && (f.out != "" || f.errOut != "") {
+		return fmt.Errorf("-out and -err-out cannot be used with -o %s", f.output)
+	}
+	if f.syslogAddr != "" && f.format != dla.FormatSyslog {
+		return fmt.Errorf("-syslog-addr requires -o %s", dla.FormatSyslog)
+	}
+	if f.addr != "" && f.output != outputTCP && !f.serve {
+		return fmt.Errorf("-addr requires -o %s or serve", outputTCP)
+	}
+
+	if f.gzip && f.out == "" && f.errOut == "" {
+		return fmt.Errorf("-gzip requires -out or -err-out")
+	}
+	if f.rotateSize != "" {
+		n, err := parseSize(f.rotateSize)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid -rotate-size value %q: expected a size such as 500KB or 100MB", f.rotateSize)
+		}
+		if f.out == "" && f.errOut == "" {
+			return fmt.Errorf("-rotate-size requires -out or -err-out")
+		}
+		f.rotateBytes = n
+	}
+	if f.rotateKeep < 0 {
+		return fmt.Errorf("invalid -rotate-keep value %d: must not be negative", f.rotateKeep)
+	}
+	if f.errOut != "" && f.format.Structured() {
+		return fmt.Errorf("-err-out cannot be used with -o %s, both streams are written as one", f.output)
+	}
+
+	if f.regex && f.glob {
+		return fmt.Errorf("-regex and -glob are mutually exclusive")
+	}
+
+	for _, pattern := range f.exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid -exclude pattern %q: %s", pattern, err)
+		}
+	}
+
+	if f.maxTag < 0 {
+		return fmt.Errorf("invalid -max-tag value %d: must not be negative", f.maxTag)
+	}
+
+	if err := checkChoice("align", f.align, alignChoices); err != nil {
+		return err
+	}
+
+	if err := checkChoice("prefix-position", f.position, positionChoices); err != nil {
+		return err
+	}
+	if dla.Position(f.position) == dla.PositionAfter && f.template != "" {
+		return fmt.Errorf("-prefix-position %s cannot be used with -template", dla.PositionAfter)
+	}
+
+	if err := checkChoice("seq-position", f.seqPosition, positionChoices); err != nil {
+		return err
+	}
+	if f.seq && f.raw {
+		return fmt.Errorf("-seq cannot be used with -raw, raw output is not split into lines")
+	}
+
+	if err := checkChoice("match", f.match, matchChoices); err != nil {
+		return err
+	}
+
+	if err := checkChoice("color-by", f.colorBy, colorByChoices); err != nil {
+		return err
+	}
+
+	if f.colors != "" {
+		palette, err := dla.ParsePalette(f.colors)
+		if err != nil {
+			return fmt.Errorf("invalid -colors value %q: %s", f.colors, err)
+		}
+		f.palette = palette
+	}
+
+	if f.stderrColor != "" {
+		c, err := dla.ParseStyle(f.stderrColor)
+		if err != nil {
+			return fmt.Errorf("invalid -stderr-color value %q: %s", f.stderrColor, err)
+		}
+		f.errColor = c
+	}
+
+	if f.template != "" {
+		tmpl, err := template.New("prefix").Parse(f.template)
+		if err != nil {
+			return fmt.Errorf("invalid -template: %s", err)
+		}
+		f.tmpl = tmpl
+	}
+
+	f.loc = time.Local
+	switch {
+	case f.utc && f.tz != "":
+		return fmt.Errorf("-utc and -tz are mutually exclusive")
+	case f.utc:
+		f.loc = time.UTC
+	case f.tz != "":
+		loc, err := time.LoadLocation(f.tz)
+		if err != nil {
+			return fmt.Errorf("invalid -tz value %q: %s", f.tz, err)
+		}
+		f.loc = loc
+	}
+
+	f.layout = f.timeFormat
+	if layout, ok := timePresets[f.timeFormat]; ok {
+		f.layout = layout
+	}
+
+	if f.since != "" {
+		since, err := parseTime(f.since, now)
+		if err != nil {
+			return fmt.Errorf("invalid -since value %q: %s", f.since, err)
+		}
+		f.sinceUnix = since.Unix()
+	}
+
+	if f.until != "" {
+		until, err := parseTime(f.until, now)
+		if err != nil {
+			return fmt.Errorf("invalid -until value %q: %s", f.until, err)
+		}
+		f.untilUnix = until.Unix()
+
+		if f.since != "" && f.untilUnix < f.sinceUnix {
+			return fmt.Errorf("-until %q is before -since %q", f.until, f.since)
+		}
+	}
+
+	if f.healthRE != dla.HealthcheckPattern && !f.noHealth {
+		return fmt.Errorf("-healthcheck-pattern requires -no-healthcheck")
+	}
+	if f.noHealth {
+		if _, err := regexp.Compile(f.healthRE); err != nil {
+			return fmt.Errorf("invalid -healthcheck-pattern %q: %s", f.healthRE, err)
+		}
+	}
+
+	if f.grep != "" || f.grepV != "" || f.noHealth {
+		f.filter = &dla.LineFilter{}
+		if f.grep != "" {
+			re, err := regexp.Compile(f.grep)
+			if err != nil {
+				return fmt.Errorf("invalid -grep pattern %q: %s", f.grep, err)
 			}
-			conts = append(conts, contr.conts...)
+			f.filter.Include = re
+		}
+
+		// -no-healthcheck adds its pattern to those -grep-v drops
+		var excludes []string
+		if f.grepV != "" {
+			if _, err := regexp.Compile(f.grepV); err != nil {
+				return fmt.Errorf("invalid -grep-v pattern %q: %s", f.grepV, err)
+			}
+			excludes = append(excludes, "(?:"+f.grepV+")")
+		}
+		if f.noHealth {
+			excludes = append(excludes, "(?:"+f.healthRE+")")
+		}
+		if len(excludes) > 0 {
+			f.filter.Exclude = regexp.MustCompile(strings.Join(excludes, "|"))
 		}
 	}
 
-	// dedupe containers
-	found := map[string]struct{}{}
-	out := conts[:0]
-	for _, cont := range conts {
-		if _, ok := found[cont.ID]; !ok {
-			out = append(out, cont)
+	if f.multiline != "" {
+		re, err := regexp.Compile(f.multiline)
+		if err != nil {
+			return fmt.Errorf("invalid -multiline pattern %q: %s", f.multiline, err)
 		}
+		f.multiRE = re
 	}
 
-	return out, nil
-}
+	for _, label := range f.labels {
+		if i := strings.IndexByte(label, '='); i <= 0 {
+			return fmt.Errorf("invalid -label value %q: expected key=value", label)
+		}
+	}
 
-func getAllContainers(client *docker.Client) ([]docker.APIContainers, error) {
-	return client.ListContainers(docker.ListContainersOptions{})
+	if f.status != "" {
+		for _, status := range strings.Split(f.status, ",") {
+			status = strings.TrimSpace(status)
+			if !dla.ValidStatus(status) {
+				return fmt.Errorf("invalid -status value %q", status)
+			}
+			f.statuses = append(f.statuses, status)
+		}
+	}
+
+	return nil
 }
 
-func getContainerForName(client *docker.Client, name string) ([]docker.APIContainers, error) {
-	return client.ListContainers(docker.ListContainersOptions{
-		Filters: map[string][]string{
-			"label": []string{swarmServiceNameKey + "=" + name},
-		},
-	})
+// timePresets are the -time-format names standing in for a layout.
+var timePresets = map[string]string{
+	"kitchen":  time.Kitchen,
+	"rfc3339":  time.RFC3339,
+	"epoch":    dla.TimeLayoutEpoch,
+	"epoch-ms": dla.TimeLayoutEpochMillis,
 }
 
-const (
-	postFix = " | "
-)
+// parseTime accepts either a duration, taken as that long before now, or an
+// RFC3339 timestamp.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
 
-func getTags(conts []docker.APIContainers) []string {
-	tags := make([]string, 0, len(conts))
-	for _, cont := range conts {
-		tags = append(tags, cont.Labels[swarmTaskNameKey])
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a duration or RFC3339 timestamp")
 	}
-	return tags
+
+	return t, nil
 }
 
-func logContainers(client *docker.Client, conts []docker.APIContainers) {
-	if client == nil || len(conts) <= 0 {
-		return
-	}
-
-	tagFmt := tagConfig(getTags(conts), " | ")
-
-	wOut := NewFanInWriter(os.Stdout)
-	wErr := NewFanInWriter(os.Stderr)
-
-	wg := sync.WaitGroup{}
-	wg.Add(len(conts))
-
-	for _, cont := range conts {
-		name := cont.Labels[swarmTaskNameKey]
-		tag := tagFmt(name)
-		go func(cont docker.APIContainers) {
-			defer wg.Done()
-			err := client.Logs(docker.LogsOptions{
-				Container:    cont.ID,
-				Stdout:       true,
-				OutputStream: LineWriter(wOut, tag, nil),
-				Stderr:       true,
-				ErrorStream:  LineWriter(wErr, tag, color.New(color.FgHiRed)),
-				Follow:       flags.follow,
-				Tail:         flags.tail,
-			})
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Logger failed for %s: %s\n", name, err)
-				os.Exit(1)
-			}
+// options translates the parsed flags into aggregator options. errOut is
+// where stderr lines are written in text mode.
+func (f *flgs) options(errOut io.Writer) dla.Options {
+	opts := dla.Options{
+		Follow:       f.follow,
+		Tail:         f.tail,
+		Since:        f.sinceUnix,
+		Until:        f.untilUnix,
+		NoStdout:     f.stderrOnly,
+		NoStderr:     f.stdoutOnly,
+		SinceStart:   f.sinceStart,
+		Timestamps:   f.ts,
+		Details:      f.details,
+		TimeLocation: f.loc,
+		TimeLayout:   f.layout,
+		Format:       f.format,
+		Raw:          f.raw,
+		SyslogAddr:   f.syslogAddr,
+		ColorBy:      dla.ColorBy(f.colorBy),
+		Palette:      f.palette,
+		StderrColor:  f.errColor,
+		Separator:    f.sep,
+		Align:        dla.Align(f.align),
+		TagPosition:  dla.Position(f.position),
+		Seq:          f.seq,
+		SeqPosition:  dla.Position(f.seqPosition),
+		MaxTag:       f.maxTag,
+		TagLabel:     f.tagLabel,
+		ShowID:       f.showID,
+		ShowNode:     f.showNode,
+		Template:     f.tmpl,
+		Filter:       f.filter,
+		MaxLine:      f.maxLine,
+		KeepCR:       f.keepCR,
+		StripANSI:    f.stripANSI,
+		Rate:         f.rate,
+		Dedupe:       f.dedupe,
+		Multiline:    f.multiRE,
+		Match:        dla.Match(f.match),
+		Exclude:      f.exclude,
+		Statuses:     f.statuses,
+		Reconnect:    f.reconnect,
+		Watch:        f.watch,
+		ExitGrace:    f.exitGrace,
+		EOFGrace:     f.eofGrace,
+		ServiceLogs:  f.serviceLogs,
+		Refresh:      f.refresh,
+		Buffer:       f.buffer,
+		DropOldest:   f.drop,
+		Concurrency:  f.concurrency,
+		ListTimeout:  f.connTimeout,
+		MaxLines:     f.maxLines,
+		Head:         f.head,
+		Summary:      !f.quiet,
+		ErrOut:       errOut,
+		Info:         os.Stdout,
+		Errors:       os.Stderr,
+	}
 
-			fmt.Printf("Stream %s exited.\n", name)
-		}(cont)
+	if f.merge {
+		opts.Merge = dla.DefaultMergeWindow
+	}
+	if f.quiet {
+		opts.Info = nil
+	}
+	if opts.Format.Structured() {
+		// both streams share stdout, the stream field tells them apart
+		opts.ErrOut = nil
 	}
 
-	wg.Wait()
+	return opts
 }
 
-var colors = []*color.Color{
-	color.New(color.FgHiRed),
-	color.New(color.FgHiGreen),
-	color.New(color.FgHiYellow),
-	color.New(color.FgHiBlue),
-	color.New(color.FgHiMagenta),
-	color.New(color.FgHiCyan),
-	color.New(color.FgRed),
-	color.New(color.FgGreen),
-	color.New(color.FgYellow),
-	color.New(color.FgBlue),
-	color.New(color.FgMagenta),
-	color.New(color.FgCyan),
-}
+// selectors builds the selectors for the swarm service names, images,
+// container names, networks, labels and -filter expression requested. No
+// selectors at all means every container. The selectors of literal names are
+// tracked so that those matching nothing can be reported.
+func selectors(names, images, containers, networks, labels []string) ([]dla.Selector, []*trackedSelector, error) {
+	sels := make([]dla.Selector, 0, len(names)+len(images)+len(containers)+len(networks)+1)
+	var tracked []*trackedSelector
+	track := func(what, name string, sel dla.Selector) {
+		ts := &trackedSelector{what: what, name: name}
+		tracked = append(tracked, ts)
+		sels = append(sels, ts.wrap(sel))
+	}
+
+	if (flags.regex || flags.glob) && len(names) > 0 {
+		pattern := dla.RegexSelector
+		if flags.glob {
+			pattern = dla.GlobSelector
+		}
+		sel, err := pattern(names)
+		if err != nil {
+			return nil, nil, err
+		}
+		sels = append(sels, sel)
+	} else {
+		selector := dla.NameSelector
+		if flags.compose {
+			selector = dla.ComposeSelector
+		}
+		for _, name := range names {
+			track("service", name, selector(name))
+		}
+	}
+
+	for _, image := range images {
+		track("image", image, dla.ImageSelector(image))
+	}
+
+	for _, name := range containers {
+		track("container", name, dla.ContainerSelector(name))
+	}
+
+	for _, network := range networks {
+		track("network", network, dla.NetworkSelector(network))
+	}
+
+	if len(labels) > 0 {
+		sels = append(sels, dla.LabelSelector(labels...))
+	}
+
+	if flags.expr != "" {
+		sel, err := dla.ExprSelector(flags.expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		sels = append(sels, sel)
+	}
 
-func tagConfig(tags []string, postFix string) func(string) []byte {
-	sort.Strings(tags)
+	return sels, tracked, nil
+}
 
-	var tagLength int
-	for i := range tags {
-		if l := len(tags[i]); l > tagLength {
-			tagLength = l
+// readNames reads one name per line from r, skipping blank lines and those
+// starting with #.
+func readNames(r io.Reader) ([]string, error) {
+	var names []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		if name := strings.TrimSpace(scan.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
 		}
 	}
+	return names, scan.Err()
+}
 
-	cm := map[string][]byte{}
-	for i, tag := range tags {
-		fmtTag := tag
-		fmtTag += strings.Repeat(" ", tagLength-len(tag))
-		fmtTag += postFix
-		cm[tag] = []byte(colors[i%len(colors)].Sprint(fmtTag))
+// dedupe drops repeats from names, keeping the first of each.
+func dedupe(names []string) []string {
+	seen := map[string]struct{}{}
+	out := names[:0]
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			out = append(out, name)
+		}
 	}
+	return out
+}
+
+// trackedSelector records whether a selector matched anything when last
+// resolved.
+type trackedSelector struct {
+	what    string
+	name    string
+	matched atomic.Bool
+}
 
-	return func(tag string) []byte {
-		return cm[tag]
+func (ts *trackedSelector) wrap(sel dla.Selector) dla.Selector {
+	return func(client dla.DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		conts, err := sel(client, opts)
+		ts.matched.Store(len(conts) > 0)
+		return conts, err
 	}
 }
 
-func LineWriter(w io.Writer, tag []byte, color *color.Color) io.Writer {
-	r, in := io.Pipe()
+// warnUnmatched writes a warning to w for each of tracked that matched no
+// containers.
+func warnUnmatched(w io.Writer, tracked []*trackedSelector) {
+	for _, ts := range tracked {
+		if !ts.matched.Load() {
+			fmt.Fprintf(w, "No containers match %s %q\n", ts.what, ts.name)
+		}
+	}
+}
 
-	go func() {
-		scan := bufio.NewScanner(r)
-		for scan.Scan() {
-			var logLine []byte
-			if color != nil {
-				logLine = []byte(color.Sprint(scan.Text()))
-			} else {
-				logLine = scan.Bytes()
-			}
-			if _, err := fullWrite(w, append(tag, append(logLine, []byte("\n")...)...)); err != nil {
-				fmt.Printf("Error attempting to write to dest: %s\n", err)
-				break
+// outputs opens the destinations for stdout and stderr lines. The returned
+// close func must be called once the streams are done.
+func (f *flgs) outputs() (out, errOut io.Writer, closeFn func() error, err error) {
+	var files []io.Closer
+	closeFn = func() error {
+		var firstErr error
+		for _, file := range files {
+			if err := file.Close(); err != nil && firstErr == nil {
+				firstErr = err
 			}
 		}
-		if scanErr := scan.Err(); scanErr != nil {
-			fmt.Printf("Error recieving write from source: %s\n", scanErr)
+		return firstErr
+	}
+
+	out, errOut = os.Stdout, os.Stderr
+	if f.serve {
+		hub := dla.NewHub()
+		shutdown, err := serveHub(f.addr, hub)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		files = append(files, closerFunc(shutdown))
+		out, errOut = hub, hub
+	}
+	if f.output == outputTCP {
+		tw := dla.NewTCPWriter(f.addr, os.Stderr)
+		files = append(files, tw)
+		out, errOut = tw, tw
+	}
+	if f.out != "" {
+		file, err := f.openOutput(f.out)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		files = append(files, file)
+		out = file
+		if f.outStderr {
+			errOut = file
 		}
-	}()
+	}
+	if f.errOut != "" {
+		file, err := f.openOutput(f.errOut)
+		if err != nil {
+			closeFn()
+			return nil, nil, nil, err
+		}
+		files = append(files, file)
+		errOut = file
+	}
+
+	return out, errOut, closeFn, nil
+}
 
-	return in
+// closerFunc adapts a func to io.Closer.
+type closerFunc func() error
+
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 }
 
-func scanLinesKeepCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// openOutput opens the file at path for output, rotated with -rotate-size.
+func (f *flgs) openOutput(path string) (io.WriteCloser, error) {
+	if f.rotateBytes > 0 {
+		return dla.NewRotatingWriter(path, f.rotateBytes, f.rotateKeep, f.wrapFile)
 	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 1, data[0 : i+1], nil
+
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
 	}
-	// If we're at EOF, we have a final, non-terminated line. Return it.
-	if atEOF {
-		return len(data), data, nil
+	return f.wrapFile(file), nil
+}
+
+// wrapFile compresses a file opened for output with -gzip. Appending to an
+// existing gzip file adds a member gunzip reads on from the last.
+func (f *flgs) wrapFile(w io.WriteCloser) io.WriteCloser {
+	if f.gzip {
+		return dla.NewGzipWriter(w, dla.DefaultGzipFlush)
 	}
-	// Request more data.
-	return 0, nil, nil
+	return w
 }
 
-type FanInWriter struct {
-	mu  sync.Mutex
-	out io.Writer
+// sizeUnits are the suffixes parseSize accepts, in powers of 1024.
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
 }
 
-func NewFanInWriter(w io.Writer) *FanInWriter {
-	if w == nil {
-		return nil
+// parseSize parses a byte count with an optional unit such as 100MB.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.n
+			break
+		}
 	}
 
-	return &FanInWriter{
-		out: w,
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
 	}
+	return n * unit, nil
 }
 
-func (fiw *FanInWriter) Write(b []byte) (n int, err error) {
-	fiw.mu.Lock()
-	n, err = fullWrite(fiw.out, b)
-	fiw.mu.Unlock()
-	return
+func main() {
+	os.Exit(run())
 }
 
-func fullWrite(w io.Writer, b []byte) (n int, err error) {
-	for n < len(b) {
-		lw, err := w.Write(b[n:])
-		n += lw
+// run is main without the os.Exit so deferred cleanup happens before the
+// process exits.
+func run() int {
+	// "dla serve [flags] [services]" streams to HTTP clients instead of
+	// stdout
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		flags.serve = true
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(flag.CommandLine, flags.config); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load config: %s\n", err)
+		return 2
+	}
+	if err := flags.parse(time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if flags.completion != "" {
+		if err := writeCompletion(os.Stdout, flags.completion); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		return 0
+	}
+
+	// color.NoColor already defaults to true when stdout is not a terminal,
+	// keep escape codes out of -out files too
+	if flags.noColor || flags.out != "" || flags.errOut != "" || flags.serve || flags.output != string(dla.FormatText) {
+		color.NoColor = true
+	}
+
+	var client *docker.Client
+	err := retry(flags.retries, func() (err error) {
+		client, err = newClient(flags.host, flags.tls)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to setup connection to docker: %s\n", err)
+		return 1
+	}
+
+	if flags.listSvcs {
+		if err := listServices(os.Stdout, client, flags.compose); err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing services: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	names := flag.Args()
+	if flags.stdin {
+		read, err := readNames(os.Stdin)
 		if err != nil {
-			return n, err
+			fmt.Fprintf(os.Stderr, "Error reading names from stdin: %s\n", err)
+			return 1
+		}
+		names = dedupe(append(names, read...))
+	}
+
+	sels, tracked, err := selectors(names, flags.images, flags.containers, flags.networks, flags.labels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	out, errOut, closeOut, err := flags.outputs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open output: %s\n", err)
+		return 1
+	}
+	defer func() {
+		if err := closeOut(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing output: %s\n", err)
+		}
+	}()
+
+	opts := flags.options(errOut)
+	opts.APIVersion = serverAPIVersion(client)
+	agg := dla.New(client, out, opts)
+
+	var conts []docker.APIContainers
+	err = retry(flags.retries, func() (err error) {
+		conts, err = agg.Containers(sels...)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving container information: %s\n", err)
+		return 1
+	}
+	if !flags.quiet {
+		warnUnmatched(os.Stderr, tracked)
+	}
+	if len(conts) <= 0 {
+		if !flags.quiet {
+			fmt.Println("No services meet the criteria")
+		}
+		return 0
+	}
+
+	if flags.list {
+		if err := agg.List(os.Stdout, conts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if flags.maxDuration > 0 {
+		// ends the streams just as an interrupt does, whichever comes first
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.maxDuration)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- agg.Stream(ctx, sels, conts)
+	}()
+
+	var streamErr error
+	select {
+	case streamErr = <-done:
+	case <-ctx.Done():
+		// give the streams a moment, after any -exit-grace, to flush their
+		// final lines, streams that failed before the interrupt still fail
+		// the run
+		select {
+		case streamErr = <-done:
+		case <-time.After(flags.exitGrace + shutdownGrace):
+			fmt.Fprintln(os.Stderr, "Timed out waiting for log streams to close")
+			return 1
 		}
 	}
 
-	return n, nil
+	if streamErr != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", streamErr)
+		return 1
+	}
+
+	return 0
+}
+
+const shutdownGrace = 2 * time.Second
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// retry calls fn until it succeeds or has been retried n times, backing off
+// exponentially in between. The last error is returned.
+func retry(n int, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= n {
+			return err
+		}
+
+		if !flags.quiet {
+			fmt.Fprintf(os.Stderr, "Docker unavailable, retrying in %s (%d/%d): %s\n", delay, attempt+1, n, err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
 }
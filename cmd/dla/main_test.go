@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// defaultFlags is the flag values dla starts with before the command line is
+// parsed.
+func defaultFlags() flgs {
+	return flags
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(f *flgs)
+		wantErr string
+	}{
+		{name: "defaults", set: func(f *flgs) {}},
+		{name: "tail lines", set: func(f *flgs) { f.tail = "100" }},
+		{name: "tail all", set: func(f *flgs) { f.tail = "all" }},
+		{name: "negative tail", set: func(f *flgs) { f.tail = "-1" }, wantErr: `invalid -t value "-1"`},
+		{name: "json", set: func(f *flgs) { f.output = "json" }},
+		{name: "unknown output", set: func(f *flgs) { f.output = "xml" }, wantErr: `invalid -o value "xml"`},
+		{name: "tcp without addr", set: func(f *flgs) { f.output = "tcp" }, wantErr: "-o tcp requires -addr"},
+		{name: "tcp", set: func(f *flgs) { f.output, f.addr = "tcp", "localhost:5000" }},
+		{name: "tcp format", set: func(f *flgs) { f.output, f.addr, f.tcpFormat = "tcp", "localhost:5000", "syslog" }, wantErr: `invalid -tcp-format value "syslog"`},
+		{name: "raw json", set: func(f *flgs) { f.raw, f.output = true, "json" }, wantErr: "-raw cannot be used with -o json"},
+		{name: "raw until", set: func(f *flgs) { f.raw, f.until = true, "1m" }, wantErr: "-until cannot be used with -raw"},
+		{name: "service until", set: func(f *flgs) { f.serviceLogs, f.until = true, "1m" }, wantErr: "-until cannot be used with -service"},
+		{name: "details without service", set: func(f *flgs) { f.details = true }, wantErr: "-details requires -service"},
+		{name: "details", set: func(f *flgs) { f.details, f.serviceLogs = true, true }},
+		{name: "watch without follow", set: func(f *flgs) { f.watch = true }, wantErr: "-watch requires -f"},
+		{name: "drop without buffer", set: func(f *flgs) { f.drop = true }, wantErr: "-drop requires -buffer"},
+		{name: "exit grace", set: func(f *flgs) { f.exitGrace = time.Second }},
+		{name: "negative exit grace", set: func(f *flgs) { f.exitGrace = -time.Second }, wantErr: "invalid -exit-grace value -1s"},
+		{name: "eof grace", set: func(f *flgs) { f.eofGrace = time.Second }},
+		{name: "eof grace and follow", set: func(f *flgs) { f.eofGrace, f.follow = time.Second, true }, wantErr: "-no-follow-exit-grace cannot be used with -f"},
+		{name: "merge without ts", set: func(f *flgs) { f.merge = true }, wantErr: "-merge requires -ts"},
+		{name: "head and follow", set: func(f *flgs) { f.head, f.follow = 10, true }, wantErr: "-head cannot be used with -f"},
+		{name: "match all", set: func(f *flgs) { f.match = "all" }},
+		{name: "unknown match", set: func(f *flgs) { f.match = "some" }, wantErr: `invalid -match value "some": expected any or all`},
+		{name: "unknown align", set: func(f *flgs) { f.align = "center" }, wantErr: `invalid -align value "center"`},
+		{name: "after with template", set: func(f *flgs) { f.position, f.template = "after", "{{.ID}}" }, wantErr: "-prefix-position after cannot be used with -template"},
+		{name: "regex and glob", set: func(f *flgs) { f.regex, f.glob = true, true }, wantErr: "-regex and -glob are mutually exclusive"},
+		{name: "bad exclude", set: func(f *flgs) { f.exclude = stringsFlag{"["} }, wantErr: `invalid -exclude pattern "["`},
+		{name: "bad label", set: func(f *flgs) { f.labels = stringsFlag{"env"} }, wantErr: `invalid -label value "env"`},
+		{name: "bad status", set: func(f *flgs) { f.status = "running,asleep" }, wantErr: `invalid -status value "asleep"`},
+		{name: "until before since", set: func(f *flgs) { f.since, f.until = "1m", "1h" }, wantErr: `-until "1h" is before -since "1m"`},
+		{name: "bad grep", set: func(f *flgs) { f.grep = "(" }, wantErr: `invalid -grep pattern "("`},
+		{name: "health pattern alone", set: func(f *flgs) { f.healthRE = "ping" }, wantErr: "-healthcheck-pattern requires -no-healthcheck"},
+		{name: "utc and tz", set: func(f *flgs) { f.utc, f.tz = true, "UTC" }, wantErr: "-utc and -tz are mutually exclusive"},
+		{name: "gzip without out", set: func(f *flgs) { f.gzip = true }, wantErr: "-gzip requires -out or -err-out"},
+		{name: "rotate size", set: func(f *flgs) { f.out, f.rotateSize = "dla.log", "10MB" }},
+		{name: "bad rotate size", set: func(f *flgs) { f.out, f.rotateSize = "dla.log", "lots" }, wantErr: `invalid -rotate-size value "lots"`},
+		{name: "refresh without follow", set: func(f *flgs) { f.refresh = time.Second }, wantErr: "-refresh requires -f"},
+		{name: "negative refresh", set: func(f *flgs) { f.refresh, f.follow = -time.Second, true }, wantErr: "invalid -refresh value -1s: must not be negative"},
+		{name: "stdout and stderr only", set: func(f *flgs) { f.stdoutOnly, f.stderrOnly = true, true }, wantErr: "-stdout-only and -stderr-only are mutually exclusive"},
+		{name: "colors", set: func(f *flgs) { f.colors = "red,hi-blue,208" }},
+		{name: "unknown color", set: func(f *flgs) { f.colors = "red,mauve" }, wantErr: `invalid -colors value "red,mauve": unknown color "mauve"`},
+		{name: "stderr color", set: func(f *flgs) { f.stderrColor = "bold+yellow" }},
+		{name: "unknown stderr color", set: func(f *flgs) { f.stderrColor = "bold+mauve" }, wantErr: `invalid -stderr-color value "bold+mauve": unknown color "mauve"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := defaultFlags()
+			tt.set(&f)
+			err := f.parse(time.Now())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("parse() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("parse() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDerived(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	f := defaultFlags()
+	f.since, f.until = "1h", "2020-01-01T11:30:00Z"
+	f.status = "running, exited"
+	f.grepV, f.noHealth = "debug", true
+	if err := f.parse(now); err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+
+	if want := now.Add(-time.Hour).Unix(); f.sinceUnix != want {
+		t.Errorf("sinceUnix = %d, want %d", f.sinceUnix, want)
+	}
+	if want := now.Add(-30 * time.Minute).Unix(); f.untilUnix != want {
+		t.Errorf("untilUnix = %d, want %d", f.untilUnix, want)
+	}
+	if want := []string{"running", "exited"}; !reflect.DeepEqual(f.statuses, want) {
+		t.Errorf("statuses = %v, want %v", f.statuses, want)
+	}
+	if f.tail != "all" {
+		t.Errorf("tail = %q, want all", f.tail)
+	}
+	for line, drop := range map[string]bool{"debug: x": true, "GET /health 200": true, "served /": false} {
+		if got := f.filter.Exclude.MatchString(line); got != drop {
+			t.Errorf("filter drops %q = %v, want %v", line, got, drop)
+		}
+	}
+	opts := f.options(nil)
+	if opts.Match != dla.MatchAny || opts.Since != f.sinceUnix || opts.Until != f.untilUnix {
+		t.Errorf("options() = Match %q Since %d Until %d", opts.Match, opts.Since, opts.Until)
+	}
+	if opts.ListTimeout != 30*time.Second {
+		t.Errorf("options() ListTimeout = %s, want the -connect-timeout default", opts.ListTimeout)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "10m", want: now.Add(-10 * time.Minute)},
+		{value: "1h30m", want: now.Add(-90 * time.Minute)},
+		{value: "2019-12-31T23:00:00Z", want: time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{value: "yesterday", wantErr: true},
+		{value: "2019-12-31", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseTime(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "500KB", want: 500 << 10},
+		{value: "100mb", want: 100 << 20},
+		{value: "2 G", want: 2 << 30},
+		{value: "1.5GB", wantErr: true},
+		{value: "MB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{names: []string{}, want: []string{}},
+		{names: []string{"web"}, want: []string{"web"}},
+		{names: []string{"web", "web"}, want: []string{"web"}},
+		{names: []string{"web", "api", "web", "db", "api"}, want: []string{"web", "api", "db"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.names, ","), func(t *testing.T) {
+			if got := dedupe(tt.names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dedupe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadNames(t *testing.T) {
+	names, err := readNames(strings.NewReader("web\n\n  api  \n# db\ncache\n"))
+	if err != nil {
+		t.Fatalf("readNames() error = %v", err)
+	}
+	if want := []string{"web", "api", "cache"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("readNames() = %v, want %v", names, want)
+	}
+}
+
+// flakyClient fails its first fails ListContainers calls, as a daemon that is
+// still starting does.
+type flakyClient struct {
+	*dlatest.Client
+	fails int
+	calls int
+}
+
+func (fc *flakyClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	if fc.calls++; fc.calls <= fc.fails {
+		return nil, errors.New("connection refused")
+	}
+	return fc.Client.ListContainers(opts)
+}
+
+func TestRetry(t *testing.T) {
+	defer func(quiet bool) { flags.quiet = quiet }(flags.quiet)
+	flags.quiet = true
+
+	tests := []struct {
+		name      string
+		fails     int
+		retries   int
+		wantErr   string
+		wantCalls int
+	}{
+		{name: "recovers", fails: 2, retries: 3, wantCalls: 3},
+		{name: "gives up", fails: 2, retries: 1, wantErr: "connection refused", wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &flakyClient{Client: dlatest.NewClient(docker.APIContainers{ID: "a1", Names: []string{"/web"}}), fails: tt.fails}
+			agg := dla.New(client, nil, dla.Options{})
+
+			var conts []docker.APIContainers
+			err := retry(tt.retries, func() (err error) {
+				conts, err = agg.Containers()
+				return err
+			})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("retry() error = %v", err)
+			case tt.wantErr == "" && len(conts) != 1:
+				t.Errorf("resolved %d containers, want 1", len(conts))
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("retry() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if client.calls != tt.wantCalls {
+				t.Errorf("ListContainers called %d times, want %d", client.calls, tt.wantCalls)
+			}
+		})
+	}
+}
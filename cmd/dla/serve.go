@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Morgahl/dockerutils/dla"
+)
+
+// serveHub listens on addr and serves hub's events to HTTP clients. The
+// returned func disconnects the clients and stops the server.
+func serveHub(addr string, hub *dla.Hub) (shutdown func() error, err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: hub}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "Serving logs failed: %s\n", err)
+		}
+	}()
+
+	return func() error {
+		hub.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
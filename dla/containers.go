@@ -0,0 +1,333 @@
+package dla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Selector resolves a set of containers, the union of all selectors given to
+// an Aggregator is what gets streamed. opts carries the Aggregator's base
+// ListContainers options which a selector adds its filters to.
+type Selector func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+
+// NameSelector selects the containers of the swarm service name.
+func NameSelector(name string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		return client.ListContainers(withFilter(opts, "label", swarmServiceNameKey+"="+name))
+	}
+}
+
+// ComposeSelector selects the containers of the docker compose service name,
+// across every project running one.
+func ComposeSelector(name string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		return client.ListContainers(withFilter(opts, "label", composeServiceKey+"="+name))
+	}
+}
+
+// RegexSelector lists every container once and keeps those whose swarm or
+// compose service name fully matches any of patterns.
+func RegexSelector(patterns []string) (Selector, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid service pattern %q: %s", pattern, err)
+		}
+		res = append(res, re)
+	}
+
+	return serviceMatcher(func(name string) bool {
+		for _, re := range res {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// GlobSelector is RegexSelector for shell style path.Match patterns such as
+// web* or api-?.
+func GlobSelector(patterns []string) (Selector, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid service pattern %q: %s", pattern, err)
+		}
+	}
+
+	return serviceMatcher(func(name string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// serviceMatcher lists every container once and keeps those with a swarm or
+// compose service name match accepts.
+func serviceMatcher(match func(name string) bool) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		conts, err := client.ListContainers(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		out := conts[:0]
+		for _, cont := range conts {
+			if name := serviceName(cont); name != "" && match(name) {
+				out = append(out, cont)
+			}
+		}
+
+		return out, nil
+	}
+}
+
+// ImageSelector selects the containers running image or an image built on it.
+func ImageSelector(image string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		return client.ListContainers(withFilter(opts, "ancestor", image))
+	}
+}
+
+// NetworkSelector selects the containers attached to the network with the
+// name or ID network.
+func NetworkSelector(network string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		return client.ListContainers(withFilter(opts, "network", network))
+	}
+}
+
+// minIDPrefix is the shortest ID prefix ContainerSelector accepts, shorter
+// ones picking out containers almost at random.
+const minIDPrefix = 4
+
+// ContainerSelector selects the container named name regardless of any swarm
+// or compose labels. Only when no container has that name does it select by
+// ID instead, taking the full ID or a prefix of at least four characters.
+func ContainerSelector(name string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		conts, err := client.ListContainers(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		var named, prefixed []docker.APIContainers
+		for _, cont := range conts {
+			switch {
+			case hasName(cont, name):
+				named = append(named, cont)
+			case cont.ID == name, len(name) >= minIDPrefix && strings.HasPrefix(cont.ID, name):
+				prefixed = append(prefixed, cont)
+			}
+		}
+		if len(named) > 0 {
+			return named, nil
+		}
+		return prefixed, nil
+	}
+}
+
+// excluded reports whether cont matches any Options.Exclude pattern.
+func (a *Aggregator) excluded(cont docker.APIContainers) bool {
+	if len(a.opts.Exclude) == 0 {
+		return false
+	}
+
+	names := []string{serviceName(cont), getTag(cont, a.opts.TagLabel)}
+	for _, name := range cont.Names {
+		names = append(names, strings.TrimPrefix(name, "/"))
+	}
+
+	for _, pattern := range a.opts.Exclude {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasName reports whether name is one of cont's names.
+func hasName(cont docker.APIContainers, name string) bool {
+	name = strings.TrimPrefix(name, "/")
+	for _, n := range cont.Names {
+		if strings.TrimPrefix(n, "/") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelSelector selects the containers carrying every one of labels, each
+// given as key=value.
+func LabelSelector(labels ...string) Selector {
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		return client.ListContainers(withFilter(opts, "label", labels...))
+	}
+}
+
+// Containers resolves the deduplicated containers matching sels, either their
+// union or with MatchAll their intersection. No selectors at all means every
+// container. Every selector shares the Options.ListTimeout deadline.
+func (a *Aggregator) Containers(sels ...Selector) ([]docker.APIContainers, error) {
+	ctx := context.Background()
+	if a.opts.ListTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.opts.ListTimeout)
+		defer cancel()
+	}
+
+	conts, err := a.containers(ctx, sels)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("listing containers timed out after %s", a.opts.ListTimeout)
+	}
+	return conts, err
+}
+
+func (a *Aggregator) containers(ctx context.Context, sels []Selector) ([]docker.APIContainers, error) {
+	base := a.listOptions()
+	base.Context = ctx
+	conts := make([]docker.APIContainers, 0, len(sels))
+
+	switch len(sels) {
+	case 0:
+		var err error
+		if conts, err = a.client.ListContainers(base); err != nil {
+			return nil, err
+		}
+
+	default:
+		// results are kept in selector order so the containers, and so their
+		// tags and colors, come out the same whatever order the requests
+		// complete in
+		type contr struct {
+			conts []docker.APIContainers
+			err   error
+		}
+		results := make([]contr, len(sels))
+		sem := newSemaphore(a.opts.Concurrency)
+		wg := sync.WaitGroup{}
+		wg.Add(len(sels))
+		for i, sel := range sels {
+			go func(i int, sel Selector) {
+				defer wg.Done()
+				if err := sem.acquire(ctx); err != nil {
+					results[i].err = err
+					return
+				}
+				defer sem.release()
+				results[i].conts, results[i].err = sel(a.client, base)
+			}(i, sel)
+		}
+
+		wg.Wait()
+
+		for _, contr := range results {
+			if contr.err != nil {
+				return nil, contr.err
+			}
+		}
+
+		if a.opts.Match == MatchAll {
+			// count the selectors each container matched, a selector
+			// returning a container twice only counts once
+			matched := map[string]int{}
+			for _, contr := range results {
+				seen := map[string]struct{}{}
+				for _, cont := range contr.conts {
+					if _, ok := seen[cont.ID]; !ok {
+						seen[cont.ID] = struct{}{}
+						matched[cont.ID]++
+					}
+				}
+			}
+			for _, cont := range results[0].conts {
+				if matched[cont.ID] == len(sels) {
+					conts = append(conts, cont)
+				}
+			}
+		} else {
+			for _, contr := range results {
+				conts = append(conts, contr.conts...)
+			}
+		}
+	}
+
+	// dedupe and drop excluded containers, filtering in place is safe as out
+	// never grows past the element currently being read from conts
+	found := map[string]struct{}{}
+	out := conts[:0]
+	for _, cont := range conts {
+		if a.excluded(cont) {
+			continue
+		}
+		if _, ok := found[cont.ID]; !ok {
+			found[cont.ID] = struct{}{}
+			out = append(out, cont)
+		}
+	}
+
+	return out, nil
+}
+
+// containerStatuses are the states accepted by the ListContainers status
+// filter.
+var containerStatuses = map[string]struct{}{
+	"created":    {},
+	"restarting": {},
+	"running":    {},
+	"removing":   {},
+	"paused":     {},
+	"exited":     {},
+	"dead":       {},
+}
+
+// ValidStatus reports whether status is a container state docker can filter
+// on.
+func ValidStatus(status string) bool {
+	_, ok := containerStatuses[status]
+	return ok
+}
+
+// listOptions builds the base ListContainers options, applying the Statuses
+// selection. Docker only lists running containers unless All is set.
+func (a *Aggregator) listOptions() docker.ListContainersOptions {
+	var opts docker.ListContainersOptions
+
+	if len(a.opts.Statuses) > 0 {
+		opts = withFilter(opts, "status", a.opts.Statuses...)
+
+		for _, status := range a.opts.Statuses {
+			if status != "running" {
+				opts.All = true
+			}
+		}
+	}
+
+	return opts
+}
+
+// withFilter returns a copy of opts with values added to the key filter,
+// leaving the filters of opts untouched.
+func withFilter(opts docker.ListContainersOptions, key string, values ...string) docker.ListContainersOptions {
+	filters := make(map[string][]string, len(opts.Filters)+1)
+	for k, v := range opts.Filters {
+		filters[k] = v
+	}
+	filters[key] = append(filters[key][:len(filters[key]):len(filters[key])], values...)
+
+	opts.Filters = filters
+	return opts
+}
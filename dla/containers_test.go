@@ -0,0 +1,346 @@
+package dla_test
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// fleet is a set of containers covering swarm, compose and plain ones.
+func fleet() *dlatest.Client {
+	return dlatest.NewClient(
+		docker.APIContainers{ID: "w1", Names: []string{"/web.1.w1"}, Image: "nginx", Labels: map[string]string{
+			"com.docker.swarm.service.name": "web",
+			"com.docker.swarm.task.name":    "web.1.w1",
+		}},
+		docker.APIContainers{ID: "w2", Names: []string{"/web.2.w2"}, Image: "redis", Labels: map[string]string{
+			"com.docker.swarm.service.name": "web",
+			"com.docker.swarm.task.name":    "web.2.w2",
+		}},
+		docker.APIContainers{ID: "a1", Names: []string{"/api.1.a1"}, Image: "nginx", Labels: map[string]string{
+			"com.docker.swarm.service.name": "api",
+			"com.docker.swarm.task.name":    "api.1.a1",
+			"env":                           "prod",
+		}},
+		docker.APIContainers{ID: "c1", Names: []string{"/shop-db-1"}, Image: "postgres", Labels: map[string]string{
+			"com.docker.compose.service": "db",
+			"env":                        "prod",
+		}},
+		docker.APIContainers{ID: "p1", Names: []string{"/plain"}, Image: "busybox"},
+	)
+}
+
+func ids(conts []docker.APIContainers) []string {
+	out := make([]string, 0, len(conts))
+	for _, cont := range conts {
+		out = append(out, cont.ID)
+	}
+	return out
+}
+
+func TestContainers(t *testing.T) {
+	tests := []struct {
+		name  string
+		match dla.Match
+		sels  []dla.Selector
+		want  []string
+	}{
+		{
+			name: "no selectors lists every container",
+			want: []string{"w1", "w2", "a1", "c1", "p1"},
+		},
+		{
+			name: "service",
+			sels: []dla.Selector{dla.NameSelector("web")},
+			want: []string{"w1", "w2"},
+		},
+		{
+			name: "same service twice is deduped",
+			sels: []dla.Selector{dla.NameSelector("web"), dla.NameSelector("web")},
+			want: []string{"w1", "w2"},
+		},
+		{
+			name: "overlapping selectors are deduped",
+			sels: []dla.Selector{dla.ImageSelector("nginx"), dla.NameSelector("web"), dla.NameSelector("api")},
+			want: []string{"w1", "a1", "w2"},
+		},
+		{
+			name: "compose service",
+			sels: []dla.Selector{dla.ComposeSelector("db")},
+			want: []string{"c1"},
+		},
+		{
+			name: "container by name or id",
+			sels: []dla.Selector{dla.ContainerSelector("plain"), dla.ContainerSelector("c1")},
+			want: []string{"p1", "c1"},
+		},
+		{
+			name: "unknown service",
+			sels: []dla.Selector{dla.NameSelector("nope")},
+			want: []string{},
+		},
+		{
+			name:  "all of overlapping selectors",
+			match: dla.MatchAll,
+			sels:  []dla.Selector{dla.ImageSelector("nginx"), dla.NameSelector("web")},
+			want:  []string{"w1"},
+		},
+		{
+			name:  "all of disjoint selectors",
+			match: dla.MatchAll,
+			sels:  []dla.Selector{dla.NameSelector("web"), dla.NameSelector("api")},
+			want:  []string{},
+		},
+		{
+			name:  "all of a repeated selector",
+			match: dla.MatchAll,
+			sels:  []dla.Selector{dla.LabelSelector("env=prod"), dla.LabelSelector("env=prod")},
+			want:  []string{"a1", "c1"},
+		},
+		{
+			name:  "any of disjoint selectors",
+			match: dla.MatchAny,
+			sels:  []dla.Selector{dla.NameSelector("web"), dla.NameSelector("api")},
+			want:  []string{"w1", "w2", "a1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg := dla.New(fleet(), nil, dla.Options{Match: tt.match})
+			conts, err := agg.Containers(tt.sels...)
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerSelector(t *testing.T) {
+	client := dlatest.NewClient(
+		docker.APIContainers{ID: "4f2a9c81e0d3", Names: []string{"/db"}},
+		docker.APIContainers{ID: "db81e5a07bc2", Names: []string{"/cache"}},
+	)
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "db", want: []string{"4f2a9c81e0d3"}},
+		{name: "db81", want: []string{"db81e5a07bc2"}},
+		{name: "db81e5a07bc2", want: []string{"db81e5a07bc2"}},
+		{name: "4f2", want: []string{}},
+		{name: "cache", want: []string{"db81e5a07bc2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conts, err := dla.New(client, nil, dla.Options{}).Containers(dla.ContainerSelector(tt.name))
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// onNetworks is a running container named name attached to networks, each
+// given by its name and ID.
+func onNetworks(id, name string, networks map[string]string) docker.APIContainers {
+	cont := docker.APIContainers{ID: id, Names: []string{"/" + name}}
+	cont.Networks.Networks = map[string]docker.ContainerNetwork{}
+	for name, id := range networks {
+		cont.Networks.Networks[name] = docker.ContainerNetwork{NetworkID: id}
+	}
+	return cont
+}
+
+func TestNetworkSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		sels     []dla.Selector
+		want     []string
+		networks []string
+	}{
+		{name: "by name", sels: []dla.Selector{dla.NetworkSelector("front")}, want: []string{"n1", "n3"}, networks: []string{"front"}},
+		{name: "by id", sels: []dla.Selector{dla.NetworkSelector("b4c")}, want: []string{"n2", "n3"}, networks: []string{"b4c"}},
+		{
+			name:     "with other selectors, deduped",
+			sels:     []dla.Selector{dla.NetworkSelector("front"), dla.ContainerSelector("both"), dla.NetworkSelector("back")},
+			want:     []string{"n1", "n3", "n2"},
+			networks: []string{"back", "front"},
+		},
+		{name: "unknown network", sels: []dla.Selector{dla.NetworkSelector("nope")}, want: []string{}, networks: []string{"nope"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(
+				onNetworks("n1", "web", map[string]string{"front": "f00"}),
+				onNetworks("n2", "db", map[string]string{"back": "b4c"}),
+				onNetworks("n3", "both", map[string]string{"front": "f00", "back": "b4c"}),
+				docker.APIContainers{ID: "p1", Names: []string{"/plain"}},
+			)
+			conts, err := dla.New(client, nil, dla.Options{}).Containers(tt.sels...)
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+			// the daemon does the filtering
+			var networks []string
+			for _, call := range client.ListCalls {
+				networks = append(networks, call.Filters["network"]...)
+			}
+			sort.Strings(networks)
+			if !reflect.DeepEqual(networks, tt.networks) {
+				t.Errorf("ListContainers network filters = %v, want %v", networks, tt.networks)
+			}
+		})
+	}
+}
+
+func TestContainersStatuses(t *testing.T) {
+	tests := []struct {
+		statuses []string
+		want     []string
+		wantAll  bool
+	}{
+		{want: []string{"r1"}},
+		{statuses: []string{"running"}, want: []string{"r1"}},
+		{statuses: []string{"exited"}, want: []string{"e1"}, wantAll: true},
+		{statuses: []string{"running", "exited"}, want: []string{"r1", "e1"}, wantAll: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.statuses, ","), func(t *testing.T) {
+			client := dlatest.NewClient(
+				docker.APIContainers{ID: "r1", State: "running"},
+				docker.APIContainers{ID: "e1", State: "exited"},
+			)
+			conts, err := dla.New(client, nil, dla.Options{Statuses: tt.statuses}).Containers()
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+			// docker only lists stopped containers when asked for all
+			call := client.ListCalls[0]
+			if call.All != tt.wantAll || !reflect.DeepEqual(call.Filters["status"], tt.statuses) {
+				t.Errorf("ListContainers All = %v status = %v, want %v %v", call.All, call.Filters["status"], tt.wantAll, tt.statuses)
+			}
+		})
+	}
+}
+
+func TestContainersExclude(t *testing.T) {
+	agg := dla.New(fleet(), nil, dla.Options{Exclude: []string{"web", "shop-*"}})
+	conts, err := agg.Containers()
+	if err != nil {
+		t.Fatalf("Containers() error = %v", err)
+	}
+	if got, want := ids(conts), []string{"a1", "p1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Containers() = %v, want %v", got, want)
+	}
+}
+
+func TestContainersListTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		sels    []dla.Selector
+		wantErr string
+	}{
+		{name: "no limit", delay: 20 * time.Millisecond},
+		{name: "within the limit", delay: 20 * time.Millisecond, timeout: time.Second},
+		{name: "past the limit", delay: time.Second, timeout: 20 * time.Millisecond, wantErr: "listing containers timed out after 20ms"},
+		{
+			name:    "shared by every selector",
+			delay:   15 * time.Millisecond,
+			timeout: 40 * time.Millisecond,
+			sels:    []dla.Selector{chain(dla.NameSelector("web"), 4)},
+			wantErr: "listing containers timed out after 40ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fleet()
+			client.ListDelay = tt.delay
+			agg := dla.New(client, nil, dla.Options{ListTimeout: tt.timeout})
+
+			_, err := agg.Containers(tt.sels...)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Containers() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("Containers() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContainersConcurrency(t *testing.T) {
+	client := fleet()
+	client.ListDelay = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var inFlight, peak int
+	// counted is sel noting how many selectors are listing at once
+	counted := func(sel dla.Selector) dla.Selector {
+		return func(client dla.DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+			mu.Lock()
+			if inFlight++; inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}()
+			return sel(client, opts)
+		}
+	}
+
+	var sels []dla.Selector
+	for _, name := range []string{"web", "api", "web", "api", "web", "api"} {
+		sels = append(sels, counted(dla.NameSelector(name)))
+	}
+	if _, err := dla.New(client, nil, dla.Options{Concurrency: 2}).Containers(sels...); err != nil {
+		t.Fatalf("Containers() error = %v", err)
+	}
+	if peak > 2 {
+		t.Errorf("%d selectors listed at once, want at most 2", peak)
+	}
+}
+
+// chain is sel listing the containers n times one after another, as a
+// selector making several requests does.
+func chain(sel dla.Selector, n int) dla.Selector {
+	return func(client dla.DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		var conts []docker.APIContainers
+		for i := 0; i < n; i++ {
+			var err error
+			if conts, err = sel(client, opts); err != nil {
+				return nil, err
+			}
+		}
+		return conts, nil
+	}
+}
@@ -0,0 +1,428 @@
+// Package dla aggregates the logs of many docker containers into a single
+// stream, prefixing every line with a colored tag naming the container it came
+// from.
+package dla
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	swarmServiceNameKey = "com.docker.swarm.service.name"
+	swarmTaskNameKey    = "com.docker.swarm.task.name"
+	swarmNodeIDKey      = "com.docker.swarm.node.id"
+	swarmTaskIDKey      = "com.docker.swarm.task.id"
+
+	composeProjectKey = "com.docker.compose.project"
+	composeServiceKey = "com.docker.compose.service"
+	composeNumberKey  = "com.docker.compose.container-number"
+)
+
+const (
+	// DefaultSeparator is the separator the dla command puts between tags
+	// and messages.
+	DefaultSeparator = " | "
+
+	// DefaultTimeLayout renders timestamps when Options.TimeLayout is unset.
+	DefaultTimeLayout = "2006-01-02 15:04:05.000"
+
+	// TimeLayoutEpoch and TimeLayoutEpochMillis are TimeLayouts rendering
+	// timestamps as Unix seconds or milliseconds rather than a time.Format
+	// layout.
+	TimeLayoutEpoch       = "epoch"
+	TimeLayoutEpochMillis = "epoch-ms"
+)
+
+// Format selects how aggregated lines are rendered.
+type Format string
+
+const (
+	// FormatText prefixes each line with its padded, colored tag.
+	FormatText Format = "text"
+	// FormatJSON emits each line as a JSON object, see JSONLineWriter.
+	FormatJSON Format = "json"
+	// FormatLogfmt emits each line as logfmt key=value pairs, see
+	// LogfmtLineWriter.
+	FormatLogfmt Format = "logfmt"
+	// FormatSyslog sends each line to syslog rather than the Aggregator's
+	// writers, tagged with its container and logged at err severity for
+	// stderr, see Options.SyslogAddr.
+	FormatSyslog Format = "syslog"
+)
+
+// Structured reports whether f describes each line's origin in fields rather
+// than a colored tag, writing both streams to the same writer.
+func (f Format) Structured() bool {
+	return f == FormatJSON || f == FormatLogfmt
+}
+
+// ColorBy selects what tag colors distinguish in FormatText.
+type ColorBy string
+
+const (
+	// ColorByContainer colors each tag by a hash of it, so a container keeps
+	// its color between runs whichever other containers are streamed.
+	ColorByContainer ColorBy = "container"
+	// ColorByIndex cycles through the colors in sorted tag order.
+	ColorByIndex ColorBy = "index"
+	// ColorByStream colors tags by the stream they came from, all stdout tags
+	// sharing one color and all stderr tags another.
+	ColorByStream ColorBy = "stream"
+)
+
+// Align selects which side of a tag FormatText pads to line tags up.
+type Align string
+
+const (
+	// AlignLeft pads after the tag.
+	AlignLeft Align = "left"
+	// AlignRight pads before the tag, lining up numbered task suffixes.
+	AlignRight Align = "right"
+)
+
+// Position selects where FormatText writes a line's tag.
+type Position string
+
+const (
+	// PositionBefore leads each line with its tag.
+	PositionBefore Position = "before"
+	// PositionAfter follows each message with its tag, unpadded, leaving the
+	// messages to line up instead.
+	PositionAfter Position = "after"
+)
+
+// Match selects how the containers of several selectors are combined.
+type Match string
+
+const (
+	// MatchAny streams containers matching any selector.
+	MatchAny Match = "any"
+	// MatchAll only streams containers matching every selector.
+	MatchAll Match = "all"
+)
+
+// ErrNoContainers is returned by Run when no container matches.
+var ErrNoContainers = errors.New("no containers meet the criteria")
+
+// Options configures an Aggregator. The zero value streams the available
+// logs of running containers once in FormatText.
+type Options struct {
+	// Follow keeps streaming new lines once the history selected by Tail,
+	// Since and Until has been written, so that Tail "100" backfills a
+	// hundred lines before following. A stream reattached after dropping
+	// only picks up lines logged since.
+	Follow bool
+	// Tail is the number of lines from the end of each container's logs to
+	// start from, or all, as docker's LogsOptions.Tail.
+	Tail string
+	// Since and Until bound the logs streamed, in Unix seconds. Zero leaves
+	// that end unbounded. Until is applied as lines arrive rather than by
+	// docker: those stamped after it are dropped and a followed stream ends
+	// once it passes. Under Raw only the follow is bounded.
+	Since int64
+	Until int64
+	// SinceStart starts each container's logs from when it last started, in
+	// place of Since, for clients able to inspect containers (see
+	// ContainerInspector). Since is used for any that cannot be inspected.
+	SinceStart bool
+	// NoStdout and NoStderr ask docker not to send that stream at all.
+	NoStdout bool
+	NoStderr bool
+
+	// Timestamps requests docker's timestamps and renders them after the tag
+	// in TimeLocation using TimeLayout (DefaultTimeLayout when empty), see
+	// TimeLayoutEpoch.
+	Timestamps   bool
+	TimeLocation *time.Location
+	TimeLayout   string
+	// Details requests the extra attributes docker's log driver records with
+	// each line, such as labels or environment variables, and renders them
+	// before the message or as fields. Only ServiceLogs streams carry them;
+	// daemons too old to send them stream without.
+	Details bool
+
+	// Merge holds lines for this long to print them in timestamp order across
+	// streams rather than as they arrive, see Merger. It requires Timestamps.
+	Merge time.Duration
+
+	Format Format
+	// Raw copies containers' output to the writers byte for byte, ignoring
+	// Format and every per-line option. Line counts are not kept.
+	Raw bool
+	// SyslogAddr is the syslog daemon FormatSyslog logs to, such as
+	// udp://host:514, the local daemon when empty.
+	SyslogAddr string
+	ColorBy    ColorBy
+	// Align pads tags on the left or right, AlignLeft when empty.
+	Align Align
+	// Seq numbers every line written, across all streams and in the order
+	// they are written, zero padded before the tag or with SeqPosition
+	// PositionAfter after it. Structured formats give it as a seq field.
+	// Under Merge lines are numbered as they arrive rather than as printed.
+	Seq         bool
+	SeqPosition Position
+	// TagPosition places tags before or after messages, PositionBefore when
+	// empty.
+	TagPosition Position
+	// MaxTag cuts tags longer than this many characters short, zero for no
+	// limit.
+	MaxTag int
+	// TagLabel names containers by the value of this label in place of their
+	// swarm task, compose or container name, for those carrying it.
+	TagLabel string
+	// ShowID follows each tag with the container's short ID and ShowNode
+	// with the swarm node its task runs on.
+	ShowID   bool
+	ShowNode bool
+	// Template, when set, renders each line's prefix from its PrefixData in
+	// place of the padded tag and timestamp.
+	Template *template.Template
+	// Separator is written between the padded tag and the message, see
+	// DefaultSeparator.
+	Separator string
+	// Palette is the colors tags are drawn from, nil for the default set.
+	Palette []*color.Color
+	// StderrColor colors stderr lines in FormatText, bright red when nil.
+	StderrColor *color.Color
+	// Filter selects the lines printed, with color enabled in FormatText
+	// the parts of a line matching its Include pattern are highlighted.
+	Filter  *LineFilter
+	MaxLine int
+	KeepCR  bool
+	// StripANSI removes escape sequences from containers' own output.
+	StripANSI bool
+	// Multiline joins continuation lines, those not matching it, onto the
+	// line before them. See WithMultiline.
+	Multiline *regexp.Regexp
+	// Dedupe collapses runs of identical lines, see WithDedupe.
+	Dedupe bool
+	// Rate caps the lines a second printed from each stream of a container,
+	// zero for no limit. See WithRate.
+	Rate float64
+
+	// Match combines the containers of multiple selectors, MatchAny when
+	// empty.
+	Match Match
+	// Exclude drops containers whose swarm or compose service, tag or
+	// container name matches any of these path.Match globs, whichever
+	// selectors matched them.
+	Exclude []string
+	// Statuses restricts selection to containers in these states, by default
+	// docker only lists running containers.
+	Statuses []string
+
+	// Reconnect is how many times a dropped stream is reattached while
+	// following.
+	Reconnect int
+	// ServiceLogs streams each swarm service as one through the daemon's
+	// service logs endpoint, covering tasks on every node, rather than
+	// attaching to its containers one by one. Lines are still tagged by
+	// task. Streams are not reconnected and Until is not honored. Clients or
+	// daemons without the endpoint stream containers as usual.
+	ServiceLogs bool
+	// Watch attaches to matching containers started while following.
+	Watch bool
+	// ExitGrace keeps each stream open this long once the context given to
+	// Run is done, so lines docker has already sent are written rather than
+	// cut off. Streams that end sooner are not waited for, and those stopped
+	// for any other reason, such as MaxLines, stop at once.
+	ExitGrace time.Duration
+	// EOFGrace keeps a one-shot read of a running container going past
+	// the end of its logs until nothing has arrived for this long, catching
+	// lines the daemon had yet to flush. Lines logged after the read began
+	// are left out and end it at once, except with Raw where only the grace
+	// does. It is ignored when following.
+	EOFGrace time.Duration
+	// Refresh re-resolves the selected containers this often while
+	// following, for daemons whose events stream is unreliable. Zero
+	// disables it.
+	Refresh time.Duration
+	// Buffer queues up to this many lines per container stream ahead of the
+	// writers, so one slow writer does not block the reading of every
+	// stream. With DropOldest a full queue discards its oldest line rather
+	// than waiting. Zero writes lines directly.
+	Buffer     int
+	DropOldest bool
+	// Concurrency caps simultaneous docker requests, zero for no limit.
+	Concurrency int
+	// ListTimeout bounds resolving the containers to stream, zero for no
+	// limit.
+	ListTimeout time.Duration
+
+	// APIVersion is the API version the daemon speaks, options it is too old
+	// for are refused or left out. Nil assumes everything is supported.
+	APIVersion docker.APIVersion
+
+	// MaxLines ends streaming once this many lines have been printed across
+	// every stream, zero for no limit.
+	MaxLines int
+
+	// Head ends each stream once it has printed this many lines, stdout and
+	// stderr together, zero for no limit. A service streamed as a unit under
+	// ServiceLogs counts as one stream.
+	Head int
+
+	// Summary writes the number of lines each stream emitted and how it
+	// ended to Errors once streaming finishes.
+	Summary bool
+
+	// ErrOut receives lines from containers' stderr, nil sends them to the
+	// Aggregator's writer too.
+	ErrOut io.Writer
+	// Info receives lifecycle notices such as streams attaching, exiting or
+	// reconnecting and Errors reports of failing streams. Either being nil
+	// discards those messages. In FormatText notices are printed under their
+	// stream's tag, in FormatJSON both are JSON objects with a level field.
+	Info   io.Writer
+	Errors io.Writer
+}
+
+// DockerClient is the subset of *docker.Client used by an Aggregator.
+type DockerClient interface {
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	Logs(opts docker.LogsOptions) error
+	AddEventListenerWithOptions(options docker.EventsOptions, listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+}
+
+var _ DockerClient = (*docker.Client)(nil)
+
+// ContainerInspector is implemented by clients able to inspect containers, as
+// *docker.Client is, which Options.SinceStart needs.
+type ContainerInspector interface {
+	InspectContainerWithOptions(opts docker.InspectContainerOptions) (*docker.Container, error)
+}
+
+var _ ContainerInspector = (*docker.Client)(nil)
+
+// Aggregator streams the logs of selected containers to a single writer.
+type Aggregator struct {
+	client   DockerClient
+	opts     Options
+	out      io.Writer
+	errOut   io.Writer
+	info     io.Writer
+	lineOpts []LineOption
+	errColor *color.Color
+}
+
+// New creates an Aggregator writing the logs it streams from client to w.
+func New(client DockerClient, w io.Writer, opts Options) *Aggregator {
+	if opts.Format == "" {
+		opts.Format = FormatText
+	}
+	if opts.Align == "" {
+		opts.Align = AlignLeft
+	}
+	if opts.TagPosition == "" {
+		opts.TagPosition = PositionBefore
+	}
+	if opts.Match == "" {
+		opts.Match = MatchAny
+	}
+	if opts.ColorBy == "" {
+		opts.ColorBy = ColorByContainer
+	}
+	if len(opts.Palette) == 0 {
+		opts.Palette = colors
+	}
+	if opts.TimeLayout == "" {
+		opts.TimeLayout = DefaultTimeLayout
+	}
+	if opts.Info == nil {
+		opts.Info = io.Discard
+	}
+	if opts.Errors == nil {
+		opts.Errors = io.Discard
+	}
+
+	a := &Aggregator{
+		client:   client,
+		opts:     opts,
+		out:      NewFanInWriter(w),
+		lineOpts: []LineOption{WithMaxLine(opts.MaxLine)},
+	}
+
+	a.errOut = a.out
+	if opts.ErrOut != nil {
+		a.errOut = NewFanInWriter(opts.ErrOut)
+	}
+
+	// notices sharing a destination with the logs take their lock so neither
+	// splits the other's lines
+	switch {
+	case sameWriter(opts.Info, w):
+		a.info = a.out
+	case sameWriter(opts.Info, opts.ErrOut):
+		a.info = a.errOut
+	default:
+		a.info = NewFanInWriter(opts.Info)
+	}
+
+	if opts.Format == FormatJSON {
+		a.info = newJSONMessages(a.info, "info")
+		a.opts.Errors = newJSONMessages(opts.Errors, "error")
+	}
+
+	a.lineOpts = append(a.lineOpts, WithErrors(a.opts.Errors))
+	if opts.KeepCR {
+		a.lineOpts = append(a.lineOpts, WithKeepCR())
+	}
+	if opts.StripANSI {
+		a.lineOpts = append(a.lineOpts, WithStripANSI())
+	}
+	if opts.Timestamps {
+		a.lineOpts = append(a.lineOpts, WithTimestamps(opts.TimeLocation, opts.TimeLayout))
+	}
+	if opts.Filter != nil {
+		a.lineOpts = append(a.lineOpts, WithFilter(opts.Filter))
+	}
+	if opts.Multiline != nil {
+		a.lineOpts = append(a.lineOpts, WithMultiline(opts.Multiline))
+	}
+	if opts.TagPosition == PositionAfter {
+		a.lineOpts = append(a.lineOpts, WithTagAfter())
+	}
+	if opts.Seq {
+		a.lineOpts = append(a.lineOpts, withSequence(&sequence{}, opts.SeqPosition == PositionAfter))
+	}
+	if opts.Dedupe {
+		a.lineOpts = append(a.lineOpts, WithDedupe())
+	}
+	if opts.Rate > 0 {
+		a.lineOpts = append(a.lineOpts, WithRate(opts.Rate))
+	}
+
+	if !color.NoColor && opts.Format == FormatText {
+		if opts.Filter != nil && opts.Filter.Include != nil {
+			a.lineOpts = append(a.lineOpts, WithHighlight(opts.Filter.Include))
+		}
+		a.errColor = opts.StderrColor
+		if a.errColor == nil {
+			a.errColor = color.New(color.FgHiRed)
+		}
+	}
+
+	return a
+}
+
+// Run resolves the containers matching sels and streams their logs until
+// they end or ctx is cancelled.
+func (a *Aggregator) Run(ctx context.Context, sels ...Selector) error {
+	conts, err := a.Containers(sels...)
+	if err != nil {
+		return err
+	} else if len(conts) <= 0 {
+		return ErrNoContainers
+	}
+
+	return a.Stream(ctx, sels, conts)
+}
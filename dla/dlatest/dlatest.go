@@ -0,0 +1,333 @@
+// Package dlatest provides an in-memory dla.DockerClient for writing
+// deterministic tests against an Aggregator without a docker daemon.
+package dlatest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Output is what a fake container's log stream produces.
+type Output struct {
+	Stdout string
+	Stderr string
+	// Err is returned by Logs once the output has been written.
+	Err error
+	// Drops makes that many Logs calls following the container fail with
+	// io.ErrUnexpectedEOF after writing the output, as a dropped connection
+	// does, before it is followed as usual.
+	Drops int
+	// Late is written to stdout LateAfter after the rest of the output, as
+	// lines still in flight are, unless opts.Context is done first.
+	Late      string
+	LateAfter time.Duration
+	// Flushed is written to stdout after the rest of the output, but only
+	// by Logs calls following the container, as lines the daemon had yet
+	// to flush are missed by a read that stops at the end of the logs.
+	Flushed string
+}
+
+// Client is a fake dla.DockerClient serving Containers and their Output. It
+// records every call made to it.
+type Client struct {
+	mu         sync.Mutex
+	containers []docker.APIContainers
+	output     map[string]Output
+	started    map[string]time.Time
+	listeners  map[chan<- *docker.APIEvents]struct{}
+
+	// ListDelay stalls every ListContainers call, which returns the error of
+	// its Context instead if that is done first.
+	ListDelay time.Duration
+
+	ListCalls        []docker.ListContainersOptions
+	LogsCalls        []docker.LogsOptions
+	ServiceLogsCalls []docker.LogsServiceOptions
+}
+
+// NewClient creates a Client listing conts.
+func NewClient(conts ...docker.APIContainers) *Client {
+	return &Client{
+		containers: conts,
+		output:     map[string]Output{},
+		started:    map[string]time.Time{},
+		listeners:  map[chan<- *docker.APIEvents]struct{}{},
+	}
+}
+
+// AddContainer makes cont visible to later ListContainers calls.
+func (c *Client) AddContainer(cont docker.APIContainers) {
+	c.mu.Lock()
+	c.containers = append(c.containers, cont)
+	c.mu.Unlock()
+}
+
+// RemoveContainer hides the container id from later ListContainers calls.
+func (c *Client) RemoveContainer(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cont := range c.containers {
+		if cont.ID == id {
+			c.containers = append(c.containers[:i:i], c.containers[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetStarted sets when the container id last started, as InspectContainer
+// reports it.
+func (c *Client) SetStarted(id string, t time.Time) {
+	c.mu.Lock()
+	c.started[id] = t
+	c.mu.Unlock()
+}
+
+// SetOutput sets what the log stream of the container id produces.
+func (c *Client) SetOutput(id string, out Output) {
+	c.mu.Lock()
+	c.output[id] = out
+	c.mu.Unlock()
+}
+
+// ListContainers returns the containers matching the label, ancestor, id,
+// network and status filters of opts.
+func (c *Client) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	if c.ListDelay > 0 {
+		ctx := opts.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.ListDelay):
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ListCalls = append(c.ListCalls, opts)
+
+	var out []docker.APIContainers
+	for _, cont := range c.containers {
+		if matches(cont, opts) {
+			out = append(out, cont)
+		}
+	}
+	return out, nil
+}
+
+func matches(cont docker.APIContainers, opts docker.ListContainersOptions) bool {
+	state := cont.State
+	if state == "" {
+		state = "running"
+	}
+	if !opts.All && len(opts.Filters["status"]) == 0 && state != "running" {
+		return false
+	}
+
+	for key, values := range opts.Filters {
+		for _, value := range values {
+			var ok bool
+			switch key {
+			case "label":
+				k, v, hasValue := strings.Cut(value, "=")
+				lv, found := cont.Labels[k]
+				ok = found && (!hasValue || lv == v)
+			case "ancestor":
+				ok = cont.Image == value
+			case "id":
+				ok = strings.HasPrefix(cont.ID, value)
+			case "network":
+				ok = onNetwork(cont, value)
+			case "status":
+				ok = anyOf(state, values)
+			default:
+				ok = true
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// onNetwork reports whether cont is attached to the network named, or with
+// the ID, network.
+func onNetwork(cont docker.APIContainers, network string) bool {
+	for name, n := range cont.Networks.Networks {
+		if name == network || n.NetworkID == network {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs writes the container's Output to the requested streams. When
+// following a running container it then blocks until opts.Context is done.
+func (c *Client) Logs(opts docker.LogsOptions) error {
+	c.mu.Lock()
+	c.LogsCalls = append(c.LogsCalls, opts)
+	out := c.output[opts.Container]
+	dropped := opts.Follow && out.Drops > 0
+	if dropped {
+		next := out
+		next.Drops--
+		c.output[opts.Container] = next
+	}
+	stopped := false
+	for _, cont := range c.containers {
+		if cont.ID == opts.Container && cont.State != "" && cont.State != "running" {
+			stopped = true
+		}
+	}
+	c.mu.Unlock()
+
+	if opts.Stdout && opts.OutputStream != nil {
+		io.WriteString(opts.OutputStream, out.Stdout)
+	}
+	if opts.Stderr && opts.ErrorStream != nil {
+		io.WriteString(opts.ErrorStream, out.Stderr)
+	}
+	if out.Late != "" && opts.Stdout && opts.OutputStream != nil {
+		select {
+		case <-done(opts.Context):
+			return opts.Context.Err()
+		case <-time.After(out.LateAfter):
+			io.WriteString(opts.OutputStream, out.Late)
+		}
+	}
+	if out.Flushed != "" && opts.Follow && opts.Stdout && opts.OutputStream != nil {
+		io.WriteString(opts.OutputStream, out.Flushed)
+	}
+
+	if dropped {
+		return io.ErrUnexpectedEOF
+	}
+	if out.Err != nil {
+		return out.Err
+	}
+	// like docker, following a stopped container returns once its logs are
+	// written
+	if opts.Follow && !stopped && opts.Context != nil {
+		<-opts.Context.Done()
+		return opts.Context.Err()
+	}
+	return nil
+}
+
+// done is ctx.Done, nil (never done) for a nil ctx.
+func done(ctx context.Context) <-chan struct{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Done()
+}
+
+// GetServiceLogs writes the Output of every container of the swarm service
+// opts.Service to the requested streams, each line led by the details naming
+// its task as docker does. Following blocks until opts.Context is done.
+func (c *Client) GetServiceLogs(opts docker.LogsServiceOptions) error {
+	c.mu.Lock()
+	c.ServiceLogsCalls = append(c.ServiceLogsCalls, opts)
+	var stdout, stderr strings.Builder
+	for _, cont := range c.containers {
+		if cont.Labels["com.docker.swarm.service.name"] != opts.Service {
+			continue
+		}
+		details := "com.docker.swarm.task.id=" + cont.Labels["com.docker.swarm.task.id"] + " "
+		out := c.output[cont.ID]
+		writeDetailed(&stdout, details, out.Stdout)
+		writeDetailed(&stderr, details, out.Stderr)
+	}
+	c.mu.Unlock()
+
+	if opts.Stdout && opts.OutputStream != nil {
+		io.WriteString(opts.OutputStream, stdout.String())
+	}
+	if opts.Stderr && opts.ErrorStream != nil {
+		io.WriteString(opts.ErrorStream, stderr.String())
+	}
+
+	if opts.Follow && opts.Context != nil {
+		<-opts.Context.Done()
+		return opts.Context.Err()
+	}
+	return nil
+}
+
+// writeDetailed writes each line of out to b led by details.
+func writeDetailed(b *strings.Builder, details, out string) {
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if line != "" {
+			b.WriteString(details + line)
+		}
+	}
+}
+
+// InspectContainerWithOptions describes the container opts.ID, with the start
+// time given by SetStarted.
+func (c *Client) InspectContainerWithOptions(opts docker.InspectContainerOptions) (*docker.Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cont := range c.containers {
+		if cont.ID == opts.ID {
+			info := &docker.Container{ID: cont.ID, Image: cont.Image}
+			info.State.Running = cont.State == "" || cont.State == "running"
+			info.State.StartedAt = c.started[cont.ID]
+			return info, nil
+		}
+	}
+	return nil, &docker.NoSuchContainer{ID: opts.ID}
+}
+
+// AddEventListenerWithOptions registers listener for events sent with Emit.
+func (c *Client) AddEventListenerWithOptions(options docker.EventsOptions, listener chan<- *docker.APIEvents) error {
+	c.mu.Lock()
+	c.listeners[listener] = struct{}{}
+	c.mu.Unlock()
+	return nil
+}
+
+// RemoveEventListener unregisters listener.
+func (c *Client) RemoveEventListener(listener chan *docker.APIEvents) error {
+	c.mu.Lock()
+	delete(c.listeners, listener)
+	c.mu.Unlock()
+	return nil
+}
+
+// Emit delivers ev to every registered listener.
+func (c *Client) Emit(ctx context.Context, ev *docker.APIEvents) {
+	c.mu.Lock()
+	listeners := make([]chan<- *docker.APIEvents, 0, len(c.listeners))
+	for l := range c.listeners {
+		listeners = append(listeners, l)
+	}
+	c.mu.Unlock()
+
+	for _, l := range listeners {
+		select {
+		case l <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package dla
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ExprSelector lists every container once and keeps those expr accepts. expr
+// compares container fields with = or != and combines comparisons with and,
+// or, not and parentheses, as in
+//
+//	service=web and not label.env=dev
+//
+// The fields are service (swarm or compose), name, image, status and
+// label.<key>. Values may be path.Match globs such as web*, and are quoted
+// as Go strings when they hold spaces or parentheses. name= matches any of a
+// container's names and name!= none of them. A missing label equals nothing
+// but the empty string.
+func ExprSelector(expr string) (Selector, error) {
+	match, err := parseExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", expr, err)
+	}
+
+	return func(client DockerClient, opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+		// stopped containers too, or status= could only ever see running ones
+		opts.All = true
+		conts, err := client.ListContainers(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		out := conts[:0]
+		for _, cont := range conts {
+			if match(cont) {
+				out = append(out, cont)
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+// predicate reports whether a container is accepted by an expression.
+type predicate func(cont docker.APIContainers) bool
+
+// exprFields look up the values of each field an expression compares, a
+// comparison holding when any of them matches.
+var exprFields = map[string]func(cont docker.APIContainers) []string{
+	"service": func(cont docker.APIContainers) []string {
+		return []string{serviceName(cont)}
+	},
+	"name": func(cont docker.APIContainers) []string {
+		if len(cont.Names) == 0 {
+			return []string{""}
+		}
+		names := make([]string, len(cont.Names))
+		for i, name := range cont.Names {
+			names[i] = strings.TrimPrefix(name, "/")
+		}
+		return names
+	},
+	"image": func(cont docker.APIContainers) []string {
+		return []string{cont.Image}
+	},
+	"status": func(cont docker.APIContainers) []string {
+		if cont.State == "" {
+			return []string{"running"}
+		}
+		return []string{cont.State}
+	},
+}
+
+// exprParser is a recursive descent parser over the tokens of an
+// expression:
+//
+//	or         = and { "or" and }
+//	and        = not { "and" not }
+//	not        = "not" not | "(" or ")" | comparison
+//	comparison = field ( "=" | "!=" ) value
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseExpr(expr string) (predicate, error) {
+	tokens, err := tokenizeExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &exprParser{tokens: tokens}
+	match, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return match, nil
+}
+
+// peek is the next token, empty at the end of the expression.
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the next token, empty at the end.
+func (p *exprParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) or() (predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(cont docker.APIContainers) bool { return l(cont) || right(cont) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) and() (predicate, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(cont docker.APIContainers) bool { return l(cont) && right(cont) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) not() (predicate, error) {
+	switch tok := p.peek(); {
+	case strings.EqualFold(tok, "not"):
+		p.next()
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(cont docker.APIContainers) bool { return !inner(cont) }, nil
+
+	case tok == "(":
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *exprParser) comparison() (predicate, error) {
+	field := p.next()
+	if field == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	lookup, ok := exprFields[field]
+	if key := strings.TrimPrefix(field, "label."); key != field && key != "" {
+		lookup = func(cont docker.APIContainers) []string {
+			return []string{cont.Labels[key]}
+		}
+	} else if !ok {
+		return nil, fmt.Errorf("unknown field %q, expected service, name, image, status or label.<key>", field)
+	}
+
+	op := p.next()
+	if op != "=" && op != "!=" {
+		return nil, fmt.Errorf("expected = or != after %s", field)
+	}
+
+	value := p.next()
+	switch {
+	case value == "" || value == "(" || value == ")" || value == "=" || value == "!=":
+		return nil, fmt.Errorf("expected a value after %s%s", field, op)
+	case value[0] == '"':
+		var err error
+		if value, err = strconv.Unquote(value); err != nil {
+			return nil, fmt.Errorf("invalid quoted value %s", p.tokens[p.pos-1])
+		}
+	}
+	if _, err := path.Match(value, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", value, err)
+	}
+
+	negate := op == "!="
+	return func(cont docker.APIContainers) bool {
+		for _, v := range lookup(cont) {
+			if ok, _ := path.Match(value, v); ok {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
+
+// tokenizeExpr splits expr into parentheses, operators, quoted strings and
+// words.
+func tokenizeExpr(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+
+		case c == '(' || c == ')' || c == '=':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+
+		case c == '!':
+			if !strings.HasPrefix(expr[i:], "!=") {
+				return nil, fmt.Errorf("unexpected ! at offset %d", i)
+			}
+			tokens = append(tokens, "!=")
+			i += 2
+
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated quote at offset %d", i)
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+
+		default:
+			j := i
+			for j < len(expr) && !unicode.IsSpace(rune(expr[j])) && !strings.ContainsRune(`()=!"`, rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,141 @@
+package dla_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestExprSelector(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{expr: "service=web", want: []string{"w1", "w2"}},
+		{expr: "service!=web", want: []string{"a1", "c1", "p1"}},
+		{expr: "service=db", want: []string{"c1"}},
+		{expr: "service=w*", want: []string{"w1", "w2"}},
+		{expr: "name=shop-*", want: []string{"c1"}},
+		{expr: "image=nginx and label.env=prod", want: []string{"a1"}},
+		{expr: "label.env=prod or image=busybox", want: []string{"a1", "c1", "p1"}},
+		{expr: `label.env=""`, want: []string{"w1", "w2", "p1"}},
+		{expr: "status=running", want: []string{"w1", "w2", "a1", "c1", "p1"}},
+		// and binds tighter than or, not tighter than and
+		{expr: "service=api or service=web and image=redis", want: []string{"w2", "a1"}},
+		{expr: "(service=api or service=web) and image=nginx", want: []string{"w1", "a1"}},
+		{expr: "not service=web and label.env=prod", want: []string{"a1", "c1"}},
+		{expr: "not (service=web or label.env=prod)", want: []string{"p1"}},
+		{expr: "not not service=api", want: []string{"a1"}},
+		{expr: "service=web AND NOT image=redis", want: []string{"w1"}},
+		{expr: `name="plain"`, want: []string{"p1"}},
+		{expr: `image="post*"`, want: []string{"c1"}},
+		{expr: `label.env="no such (value)"`, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := dla.ExprSelector(tt.expr)
+			if err != nil {
+				t.Fatalf("ExprSelector() error = %v", err)
+			}
+			conts, err := dla.New(fleet(), nil, dla.Options{}).Containers(sel)
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprSelectorNames(t *testing.T) {
+	// a container linked into another carries a name under it too
+	client := dlatest.NewClient(
+		docker.APIContainers{ID: "d1", Names: []string{"/app/db", "/db"}},
+		docker.APIContainers{ID: "a1", Names: []string{"/app"}},
+		docker.APIContainers{ID: "n1"},
+	)
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{expr: "name=db", want: []string{"d1"}},
+		{expr: "name=app/db", want: []string{"d1"}},
+		{expr: "name=app", want: []string{"a1"}},
+		{expr: "name!=db", want: []string{"a1", "n1"}},
+		{expr: `name=""`, want: []string{"n1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := dla.ExprSelector(tt.expr)
+			if err != nil {
+				t.Fatalf("ExprSelector() error = %v", err)
+			}
+			conts, err := dla.New(client, nil, dla.Options{}).Containers(sel)
+			if err != nil {
+				t.Fatalf("Containers() error = %v", err)
+			}
+			if got := ids(conts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Containers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprSelectorStatus(t *testing.T) {
+	client := dlatest.NewClient(
+		docker.APIContainers{ID: "r1"},
+		docker.APIContainers{ID: "e1", State: "exited"},
+	)
+
+	sel, err := dla.ExprSelector("status=exited")
+	if err != nil {
+		t.Fatalf("ExprSelector() error = %v", err)
+	}
+	conts, err := dla.New(client, nil, dla.Options{}).Containers(sel)
+	if err != nil {
+		t.Fatalf("Containers() error = %v", err)
+	}
+	if got, want := ids(conts), []string{"e1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Containers() = %v, want %v", got, want)
+	}
+	if len(client.ListCalls) != 1 || !client.ListCalls[0].All {
+		t.Errorf("ListCalls = %+v, want one call with All", client.ListCalls)
+	}
+}
+
+func TestExprSelectorErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{expr: "", want: "empty expression"},
+		{expr: "service", want: "expected = or != after service"},
+		{expr: "service=", want: "expected a value after service="},
+		{expr: "colour=red", want: `unknown field "colour"`},
+		{expr: "label.=x", want: `unknown field "label."`},
+		{expr: "(service=web", want: "missing )"},
+		{expr: "service=web)", want: `unexpected ")"`},
+		{expr: "service=web and", want: "unexpected end of expression"},
+		{expr: "service=web or or service=api", want: `unknown field "or"`},
+		{expr: "service!web", want: "unexpected ! at offset 7"},
+		{expr: `name="web`, want: "unterminated quote at offset 5"},
+		{expr: "name=[", want: `invalid pattern "["`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := dla.ExprSelector(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ExprSelector() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
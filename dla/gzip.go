@@ -0,0 +1,100 @@
+package dla
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultGzipFlush is how often the dla command flushes gzipped output.
+const DefaultGzipFlush = time.Second
+
+// GzipWriter compresses everything written to it into an underlying writer,
+// flushing on an interval so that a reader, or a crash, loses at most that
+// much output. Close finishes the gzip stream and closes the underlying
+// writer, leaving a valid file behind.
+type GzipWriter struct {
+	w io.WriteCloser
+
+	mu     sync.Mutex
+	zw     *gzip.Writer
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewGzipWriter creates a GzipWriter over w, flushing every interval when it
+// is positive.
+func NewGzipWriter(w io.WriteCloser, interval time.Duration) *GzipWriter {
+	gw := &GzipWriter{
+		w:    w,
+		zw:   gzip.NewWriter(w),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if interval <= 0 {
+		close(gw.done)
+		return gw
+	}
+
+	go func() {
+		defer close(gw.done)
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-gw.stop:
+				return
+			case <-tick.C:
+				gw.Flush()
+			}
+		}
+	}()
+
+	return gw
+}
+
+func (gw *GzipWriter) Write(b []byte) (int, error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.closed {
+		return 0, ErrWriterClosed
+	}
+	return gw.zw.Write(b)
+}
+
+// Flush writes out everything compressed so far.
+func (gw *GzipWriter) Flush() error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.closed {
+		return nil
+	}
+	return gw.zw.Flush()
+}
+
+// Close finishes the gzip stream and closes the underlying writer.
+func (gw *GzipWriter) Close() error {
+	gw.mu.Lock()
+	if gw.closed {
+		gw.mu.Unlock()
+		return nil
+	}
+	gw.closed = true
+	err := gw.zw.Close()
+	gw.mu.Unlock()
+
+	close(gw.stop)
+	<-gw.done
+
+	if cerr := gw.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package dla
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// hubClientBuffer is how many events a Hub queues for a client before
+// disconnecting it as unable to keep up.
+const hubClientBuffer = 256
+
+// Hub fans the lines written to it out to every connected HTTP client as
+// Server-Sent Events, one event per line. Clients only receive lines written
+// after they connect and a client too slow to keep up is disconnected rather
+// than holding up the rest or silently missing lines.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	closed  bool
+}
+
+// NewHub creates a Hub with no clients.
+func NewHub() *Hub {
+	return &Hub{
+		clients: map[chan []byte]struct{}{},
+	}
+}
+
+// Write sends b, less its line terminator, to every client as one event.
+func (h *Hub) Write(b []byte) (int, error) {
+	event := append([]byte(nil), bytes.TrimRight(b, "\r\n")...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		select {
+		case client <- event:
+		default:
+			close(client)
+			delete(h.clients, client)
+		}
+	}
+
+	return len(b), nil
+}
+
+// ServeHTTP streams events to the client until it disconnects or the Hub is
+// closed.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan []byte, hubClientBuffer)
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		if _, ok := h.clients[client]; ok {
+			delete(h.clients, client)
+		}
+		h.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-client:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Close disconnects every client once the events queued for them are sent.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for client := range h.clients {
+		close(client)
+		delete(h.clients, client)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package dla
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	// a client is subscribed once its response headers arrive
+	var clients []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+		}
+		clients = append(clients, bufio.NewReader(resp.Body))
+	}
+
+	hub.Write([]byte("one\n"))
+	hub.Write([]byte(`{"message":"two"}` + "\n"))
+
+	for i, client := range clients {
+		for _, want := range []string{"data: one", "", `data: {"message":"two"}`, ""} {
+			line, err := client.ReadString('\n')
+			if err != nil {
+				t.Fatalf("client %d: %v", i, err)
+			}
+			if got := strings.TrimSuffix(line, "\n"); got != want {
+				t.Errorf("client %d read %q, want %q", i, got, want)
+			}
+		}
+	}
+
+	hub.Close()
+	for i, client := range clients {
+		if line, err := client.ReadString('\n'); err == nil {
+			t.Errorf("client %d read %q after Close, want the stream ended", i, line)
+		}
+	}
+	if resp, err := http.Get(srv.URL); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET after Close = %v, %v, want 503", resp, err)
+	}
+}
+
+// stalledWriter is a response whose writes block until open is closed.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	open chan struct{}
+}
+
+func (sw stalledWriter) Write(b []byte) (int, error) {
+	<-sw.open
+	return sw.ResponseRecorder.Write(b)
+}
+
+func TestHubSlowClient(t *testing.T) {
+	hub := NewHub()
+	sw := stalledWriter{httptest.NewRecorder(), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hub.ServeHTTP(sw, httptest.NewRequest("GET", "/", nil))
+	}()
+
+	subscribed := func() int {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.clients)
+	}
+	for deadline := time.Now().Add(5 * time.Second); subscribed() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client")
+		}
+	}
+
+	// one event stuck being written, a full queue and one too many
+	for i := 0; i < hubClientBuffer+2; i++ {
+		hub.Write([]byte("line\n"))
+	}
+	if n := subscribed(); n != 0 {
+		t.Errorf("%d clients after falling behind, want the slow one disconnected", n)
+	}
+
+	close(sw.open)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeHTTP() did not return for the disconnected client")
+	}
+}
@@ -0,0 +1,167 @@
+package dla
+
+import (
+	"container/heap"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMergeWindow is how long lines are held for reordering when
+	// Options.Merge is enabled without a window of its own.
+	DefaultMergeWindow = 500 * time.Millisecond
+	// DefaultMergeBuffer caps how many lines a Merger holds at once.
+	DefaultMergeBuffer = 4096
+)
+
+// Merger reorders lines from several LineWriters by their docker timestamps.
+// Each line is held for the merge window before being written and lines are
+// released oldest timestamp first, so lines from different streams that
+// arrive within a window of each other are printed in event order.
+//
+// The tradeoff is latency: every line is delayed by up to the window. Lines
+// arriving more than a window after a newer line are still printed late and
+// once the buffer is full the oldest lines are written early to make room.
+type Merger struct {
+	window time.Duration
+	max    int
+
+	mu    sync.Mutex
+	lines mergeHeap
+	seq   uint64
+	err   error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMerger starts a Merger holding lines for window and at most max lines
+// at once, non-positive values selecting the defaults. Close must be called
+// once every LineWriter using it has been closed.
+func NewMerger(window time.Duration, max int) *Merger {
+	if window <= 0 {
+		window = DefaultMergeWindow
+	}
+	if max <= 0 {
+		max = DefaultMergeBuffer
+	}
+
+	m := &Merger{
+		window: window,
+		max:    max,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go m.flusher()
+
+	return m
+}
+
+// WithMerge sends LineWriter's rendered lines through m rather than writing
+// them straight to their writer. Lines are only ordered when WithTimestamps
+// is also given.
+func WithMerge(m *Merger) LineOption {
+	return func(lc *lineConfig) {
+		lc.merge = m
+	}
+}
+
+// add queues line for w. line must not be modified afterwards. Errors from
+// earlier writes are returned so the stream can stop.
+func (m *Merger) add(w io.Writer, ts time.Time, line []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	heap.Push(&m.lines, mergeLine{
+		ts:      ts,
+		seq:     m.seq,
+		arrived: time.Now(),
+		w:       w,
+		line:    line,
+	})
+
+	for m.lines.Len() > m.max {
+		m.writeOldest()
+	}
+
+	return m.err
+}
+
+// Close writes every line still held and stops the Merger, returning the
+// first write error encountered.
+func (m *Merger) Close() error {
+	close(m.stop)
+	<-m.done
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.lines.Len() > 0 {
+		m.writeOldest()
+	}
+
+	return m.err
+}
+
+func (m *Merger) flusher() {
+	defer close(m.done)
+
+	tick := time.NewTicker(m.window / 4)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-tick.C:
+			m.mu.Lock()
+			for m.lines.Len() > 0 && now.Sub(m.lines[0].arrived) >= m.window {
+				m.writeOldest()
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// writeOldest writes the line with the earliest timestamp, m.mu must be held.
+func (m *Merger) writeOldest() {
+	ml := heap.Pop(&m.lines).(mergeLine)
+	if _, err := fullWrite(ml.w, ml.line); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+type mergeLine struct {
+	ts      time.Time
+	seq     uint64
+	arrived time.Time
+	w       io.Writer
+	line    []byte
+}
+
+// mergeHeap orders lines by timestamp, falling back to arrival order.
+type mergeHeap []mergeLine
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].ts.Equal(h[j].ts) {
+		return h[i].ts.Before(h[j].ts)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeLine)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	ml := old[n-1]
+	old[n-1] = mergeLine{}
+	*h = old[:n-1]
+	return ml
+}
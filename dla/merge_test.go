@@ -0,0 +1,57 @@
+package dla
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMerger(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMerger(time.Minute, 0)
+	a := NewLineWriter(&out, []byte("a | "), nil, WithTimestamps(time.UTC, "15:04:05"), WithMerge(m))
+	b := NewLineWriter(&out, []byte("b | "), nil, WithTimestamps(time.UTC, "15:04:05"), WithMerge(m))
+
+	// b's lines arrive after a's although two of them happened first
+	a.Write([]byte("2020-01-01T00:00:02Z two\n2020-01-01T00:00:04Z four\n"))
+	b.Write([]byte("2020-01-01T00:00:01Z one\n2020-01-01T00:00:03Z three\n"))
+	for _, w := range []*LineWriter{a, b} {
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+	if got := out.String(); got != "" {
+		t.Fatalf("wrote %q within the window, want nothing yet", got)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Merger.Close() error = %v", err)
+	}
+
+	want := "b | 00:00:01 one\na | 00:00:02 two\nb | 00:00:03 three\na | 00:00:04 four\n"
+	if got := out.String(); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestMergerFull(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMerger(time.Minute, 2)
+	w := NewLineWriter(&out, []byte("t | "), nil, WithTimestamps(time.UTC, "15:04:05"), WithMerge(m))
+
+	w.Write([]byte("2020-01-01T00:00:03Z three\n2020-01-01T00:00:01Z one\n2020-01-01T00:00:02Z two\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// a third line is one past the buffer, so the oldest goes out early
+	if got, want := out.String(), "t | 00:00:01 one\n"; got != want {
+		t.Fatalf("wrote %q with the buffer full, want %q", got, want)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Merger.Close() error = %v", err)
+	}
+
+	want := "t | 00:00:01 one\nt | 00:00:02 two\nt | 00:00:03 three\n"
+	if got := out.String(); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
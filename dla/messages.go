@@ -0,0 +1,68 @@
+package dla
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// jsonMessages rewrites the plain text notices and errors written to it as
+// one JSON object per line carrying level, so that under FormatJSON every
+// line of output parses.
+type jsonMessages struct {
+	w     io.Writer
+	level string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+type jsonMessage struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func newJSONMessages(w io.Writer, level string) *jsonMessages {
+	return &jsonMessages{w: w, level: level}
+}
+
+func (jm *jsonMessages) Write(b []byte) (int, error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	jm.buf = append(jm.buf, b...)
+	for {
+		i := bytes.IndexByte(jm.buf, '\n')
+		if i < 0 {
+			break
+		}
+		msg := ansiCSI.ReplaceAll(bytes.TrimRight(jm.buf[:i], "\r"), nil)
+		jm.buf = jm.buf[i+1:]
+		if len(msg) == 0 {
+			continue
+		}
+		if err := jm.write(jsonMessage{Level: jm.level, Message: string(msg)}); err != nil {
+			return len(b), err
+		}
+	}
+	jm.buf = append(jm.buf[:0:0], jm.buf...)
+	return len(b), nil
+}
+
+// write writes v as a JSON object of its own, jm.mu must be held.
+func (jm *jsonMessages) write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fullWrite(jm.w, append(line, '\n'))
+	return err
+}
+
+// object writes v, already structured, as a line of its own.
+func (jm *jsonMessages) object(v any) error {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	return jm.write(v)
+}
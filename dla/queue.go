@@ -0,0 +1,108 @@
+package dla
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// queueWriter decouples a stream from a slow destination, holding up to a
+// fixed number of writes while a goroutine drains them to the destination.
+// When full it either blocks the stream or, with dropOldest, discards the
+// oldest queued write to make room. Writes made after Close, such as those a
+// Merger releases late, go straight to the destination.
+type queueWriter struct {
+	w          io.Writer
+	dropOldest bool
+
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu      sync.Mutex
+	queue   chan []byte
+	dropped atomic.Uint64
+	err     error
+	done    chan struct{}
+}
+
+func newQueueWriter(w io.Writer, depth int, dropOldest bool) *queueWriter {
+	if depth <= 0 {
+		depth = 1
+	}
+
+	qw := &queueWriter{
+		w:          w,
+		dropOldest: dropOldest,
+		queue:      make(chan []byte, depth),
+		done:       make(chan struct{}),
+	}
+	go qw.drain()
+
+	return qw
+}
+
+func (qw *queueWriter) drain() {
+	defer close(qw.done)
+
+	for b := range qw.queue {
+		if _, err := fullWrite(qw.w, b); err != nil {
+			qw.mu.Lock()
+			if qw.err == nil {
+				qw.err = err
+			}
+			qw.mu.Unlock()
+		}
+	}
+}
+
+// Write queues a copy of b, returning the first error the destination
+// reported.
+func (qw *queueWriter) Write(b []byte) (int, error) {
+	qw.mu.Lock()
+	err := qw.err
+	qw.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	qw.closeMu.RLock()
+	defer qw.closeMu.RUnlock()
+	if qw.closed {
+		return fullWrite(qw.w, b)
+	}
+
+	line := append([]byte(nil), b...)
+	if !qw.dropOldest {
+		qw.queue <- line
+		return len(b), nil
+	}
+
+	for {
+		select {
+		case qw.queue <- line:
+			return len(b), nil
+		default:
+		}
+
+		// full, make room by discarding the oldest write unless the
+		// drain took it first
+		select {
+		case <-qw.queue:
+			qw.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Close waits for every queued write to reach the destination.
+func (qw *queueWriter) Close() error {
+	qw.closeMu.Lock()
+	qw.closed = true
+	close(qw.queue)
+	qw.closeMu.Unlock()
+	<-qw.done
+
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	return qw.err
+}
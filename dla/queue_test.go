@@ -0,0 +1,89 @@
+package dla
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gateWriter is a destination whose writes block until open is closed, as a
+// slow terminal's do.
+type gateWriter struct {
+	open chan struct{}
+	mu   sync.Mutex
+	b    bytes.Buffer
+}
+
+func (gw *gateWriter) Write(p []byte) (int, error) {
+	<-gw.open
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.b.Write(p)
+}
+
+// writeLines writes lines 0 to n-1 to qw in the background, closing the
+// returned channel once every Write returned.
+func writeLines(qw *queueWriter, n int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			qw.Write([]byte(fmt.Sprintf("%d\n", i)))
+		}
+	}()
+	return done
+}
+
+func TestQueueWriterDropOldest(t *testing.T) {
+	gw := &gateWriter{open: make(chan struct{})}
+	qw := newQueueWriter(gw, 2, true)
+
+	select {
+	case <-writeLines(qw, 10):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() blocked behind a slow destination")
+	}
+	close(gw.open)
+	if err := qw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if qw.dropped.Load() == 0 {
+		t.Errorf("no lines dropped, want the oldest dropped")
+	}
+	got := strings.Fields(gw.b.String())
+	if len(got) == 0 || got[len(got)-1] != "9" {
+		t.Errorf("wrote %v, want it to end with the newest line", got)
+	}
+	if n := uint64(len(got)) + qw.dropped.Load(); n != 10 {
+		t.Errorf("wrote %d and dropped %d lines, want 10 in all", len(got), qw.dropped.Load())
+	}
+}
+
+func TestQueueWriterBlocks(t *testing.T) {
+	gw := &gateWriter{open: make(chan struct{})}
+	qw := newQueueWriter(gw, 2, false)
+
+	done := writeLines(qw, 10)
+	select {
+	case <-done:
+		t.Fatal("Write() returned with the queue full, want it to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gw.open)
+	<-done
+	if err := qw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	if got := gw.b.String(); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+	if n := qw.dropped.Load(); n != 0 {
+		t.Errorf("dropped %d lines, want none", n)
+	}
+}
@@ -0,0 +1,245 @@
+package dla
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rotateStamp names rotated files, sorting oldest first.
+const rotateStamp = "20060102T150405.000"
+
+// RotatingWriter appends to the file at a path until it holds a given size on
+// disk, then moves it aside under a timestamped name (out.log becomes
+// out-20060102T150405.000.log, or out-20060102T150405.000-1.log should that
+// be taken) and starts a new one. Writes are never split so files end on
+// whole lines when written a line at a time, and a file is only rotated
+// before a write once it has reached the size, so it can go over by one
+// write.
+type RotatingWriter struct {
+	path string
+	size int64
+	keep int
+	wrap func(w io.WriteCloser) io.WriteCloser
+
+	mu      sync.Mutex
+	w       io.WriteCloser
+	written atomic.Int64
+}
+
+// NewRotatingWriter opens path for appending and rotates it once it holds
+// size bytes, counting what it already holds. Writes go through wrap, such as
+// a GzipWriter, when it is not nil, the size being what wrap writes to the
+// file rather than what is written to it. With keep above zero only that many
+// rotated files are kept, the oldest being removed.
+func NewRotatingWriter(path string, size int64, keep int, wrap func(w io.WriteCloser) io.WriteCloser) (*RotatingWriter, error) {
+	rw := &RotatingWriter{
+		path: path,
+		size: size,
+		keep: keep,
+		wrap: wrap,
+	}
+
+	if err := rw.reopen(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *RotatingWriter) Write(b []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.w == nil {
+		return 0, ErrWriterClosed
+	}
+	if rw.written.Load() >= rw.size {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	return fullWrite(rw.w, b)
+}
+
+// Close closes the current file.
+func (rw *RotatingWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.w == nil {
+		return nil
+	}
+	err := rw.w.Close()
+	rw.w = nil
+	return err
+}
+
+// reopen opens the file at rw.path, rw.mu must be held.
+func (rw *RotatingWriter) reopen() error {
+	file, err := os.OpenFile(rw.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rw.written.Store(fi.Size())
+	rw.w = &countingFile{File: file, written: &rw.written}
+	if rw.wrap != nil {
+		rw.w = rw.wrap(rw.w)
+	}
+	return nil
+}
+
+// countingFile adds the bytes written to a file to written, atomically as
+// wrappers such as GzipWriter also write when flushing on their own.
+type countingFile struct {
+	*os.File
+	written *atomic.Int64
+}
+
+func (cf *countingFile) Write(b []byte) (int, error) {
+	n, err := cf.File.Write(b)
+	cf.written.Add(int64(n))
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one, rw.mu must be
+// held.
+func (rw *RotatingWriter) rotate() error {
+	err := rw.w.Close()
+	rw.w = nil
+	if err != nil {
+		return err
+	}
+
+	name, err := rw.rotatedName(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(rw.path, name); err != nil {
+		return err
+	}
+	if err := rw.reopen(); err != nil {
+		return err
+	}
+
+	return rw.prune()
+}
+
+// rotatedName is the name to move the current file aside to at now, counted
+// up from 1 past any file already rotated within the same millisecond.
+func (rw *RotatingWriter) rotatedName(now time.Time) (string, error) {
+	base, ext := rw.split()
+	stamp := base + "-" + now.Format(rotateStamp)
+	name := stamp + ext
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+		name = stamp + "-" + strconv.Itoa(n) + ext
+	}
+}
+
+// rotatedFile is a file rotate moved aside, ordered by when and then by its
+// count within the millisecond.
+type rotatedFile struct {
+	path  string
+	stamp time.Time
+	n     int
+}
+
+// parseRotated reports whether name is one rotate gave a file, returning when
+// and its count.
+func (rw *RotatingWriter) parseRotated(name string) (rotatedFile, bool) {
+	base, ext := rw.split()
+	rest, ok := strings.CutPrefix(name, base+"-")
+	if !ok {
+		return rotatedFile{}, false
+	}
+	if rest, ok = strings.CutSuffix(rest, ext); !ok {
+		return rotatedFile{}, false
+	}
+
+	rf := rotatedFile{path: name}
+	stamp, count, counted := strings.Cut(rest, "-")
+	if counted {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || strconv.Itoa(n) != count {
+			return rotatedFile{}, false
+		}
+		rf.n = n
+	}
+	t, err := time.Parse(rotateStamp, stamp)
+	if err != nil {
+		return rotatedFile{}, false
+	}
+	rf.stamp = t
+	return rf, true
+}
+
+// prune removes all but the newest rw.keep rotated files.
+func (rw *RotatingWriter) prune() error {
+	if rw.keep <= 0 {
+		return nil
+	}
+
+	base, ext := rw.split()
+	matches, err := filepath.Glob(globEscape(base) + "-*" + globEscape(ext))
+	if err != nil {
+		return err
+	}
+
+	// only files named as rotate names them, leaving others alone
+	var rotated []rotatedFile
+	for _, match := range matches {
+		if rf, ok := rw.parseRotated(match); ok {
+			rotated = append(rotated, rf)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		if !rotated[i].stamp.Equal(rotated[j].stamp) {
+			return rotated[i].stamp.Before(rotated[j].stamp)
+		}
+		return rotated[i].n < rotated[j].n
+	})
+
+	for len(rotated) > rw.keep {
+		if err := os.Remove(rotated[0].path); err != nil {
+			return fmt.Errorf("removing rotated file: %w", err)
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// split separates rw.path's extension so rotated files keep it.
+func (rw *RotatingWriter) split() (base, ext string) {
+	ext = filepath.Ext(rw.path)
+	return strings.TrimSuffix(rw.path, ext), ext
+}
+
+// globEscape quotes the characters filepath.Match treats specially.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
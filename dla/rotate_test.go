@@ -0,0 +1,212 @@
+package dla
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// files lists the names in dir.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.log")
+
+	rw, err := NewRotatingWriter(path, 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotating faster than the stamp changes leaves every file behind
+	lines := []string{"line 1 ..\n", "line 2 ..\n", "line 3 ..\n", "line 4 ..\n"}
+	for _, line := range lines {
+		if _, err := rw.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.Write([]byte("late\n")); err != ErrWriterClosed {
+		t.Errorf("Write after Close = %v, want ErrWriterClosed", err)
+	}
+
+	// the rotated names sort oldest first within a millisecond too
+	names := files(t, dir)
+	if len(names) != len(lines) {
+		t.Fatalf("files = %q, want %d", names, len(lines))
+	}
+	rotated := slices.DeleteFunc(slices.Clone(names), func(name string) bool { return name == "out.log" })
+	slices.SortFunc(rotated, func(a, b string) int {
+		ra, _ := rw.parseRotated(filepath.Join(dir, a))
+		rb, _ := rw.parseRotated(filepath.Join(dir, b))
+		if c := ra.stamp.Compare(rb.stamp); c != 0 {
+			return c
+		}
+		return ra.n - rb.n
+	})
+
+	var got []string
+	for _, name := range append(rotated, "out.log") {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	if !slices.Equal(got, lines) {
+		t.Errorf("contents = %q, want %q", got, lines)
+	}
+}
+
+func TestRotatingWriterExisting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.log")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := NewRotatingWriter(path, 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+
+	if b, _ := os.ReadFile(path); string(b) != "new\n" {
+		t.Errorf("out.log = %q, want only the new write", b)
+	}
+	if names := files(t, dir); len(names) != 2 {
+		t.Errorf("files = %q, want out.log and the full file moved aside", names)
+	}
+}
+
+func TestRotatingWriterGzip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.log.gz")
+	wrap := func(w io.WriteCloser) io.WriteCloser {
+		return NewGzipWriter(w, 0)
+	}
+
+	rw, err := NewRotatingWriter(path, 1024, 0, wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// far more than the size written, far less than it once compressed
+	line := strings.Repeat("x", 99) + "\n"
+	for range 100 {
+		if _, err := rw.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := files(t, dir); len(names) != 1 {
+		t.Fatalf("files = %q, want one, the size counting compressed bytes", names)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat(line, 100); string(got) != want {
+		t.Errorf("decompressed %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRotatedName(t *testing.T) {
+	dir := t.TempDir()
+	rw := &RotatingWriter{path: filepath.Join(dir, "out.log")}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 6e6, time.UTC)
+
+	var got []string
+	for range 3 {
+		name, err := rw.rotatedName(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.Base(name))
+	}
+
+	want := []string{
+		"out-20250102T030405.006.log",
+		"out-20250102T030405.006-1.log",
+		"out-20250102T030405.006-2.log",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func TestRotatingWriterPrune(t *testing.T) {
+	dir := t.TempDir()
+	rw := &RotatingWriter{path: filepath.Join(dir, "out.log"), keep: 3}
+
+	for _, name := range []string{
+		"out.log",
+		"out-20250102T030405.006-10.log",
+		"out-20250102T030405.006-2.log",
+		"out-20250102T030405.006.log",
+		"out-20250101T000000.000-1.log",
+		"out-20250103T000000.000.log",
+		// not named by rotate, so never removed
+		"out-keepme.log",
+		"out-20250101T000000.000-x.log",
+		"out-20250101T000000.000-01.log",
+		"out-20250101T000000.000.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rw.prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := files(t, dir)
+	want := []string{
+		"out-20250101T000000.000-01.log",
+		"out-20250101T000000.000-x.log",
+		"out-20250101T000000.000.txt",
+		"out-20250102T030405.006-10.log",
+		"out-20250102T030405.006-2.log",
+		"out-20250103T000000.000.log",
+		"out-keepme.log",
+		"out.log",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("files after prune = %q, want %q", got, want)
+	}
+}
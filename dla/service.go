@@ -0,0 +1,301 @@
+package dla
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// apiServiceLogs is the first docker API version whose service logs endpoint
+// is out of experimental.
+var apiServiceLogs = docker.APIVersion{1, 29}
+
+// ServiceLogger is implemented by clients able to stream the logs of a whole
+// swarm service, as *docker.Client is.
+type ServiceLogger interface {
+	GetServiceLogs(opts docker.LogsServiceOptions) error
+}
+
+var _ ServiceLogger = (*docker.Client)(nil)
+
+// startServices streams the swarm services of conts through the service logs
+// endpoint under Options.ServiceLogs, returning the containers left to stream
+// one by one. Those are all of conts when the client or daemon cannot.
+func (s *streamer) startServices(ctx context.Context, conts []docker.APIContainers) []docker.APIContainers {
+	if !s.opts.ServiceLogs {
+		return conts
+	}
+	sl, ok := s.client.(ServiceLogger)
+	if !ok || !s.supports(apiServiceLogs) || s.opts.Raw {
+		fmt.Fprintln(s.opts.Errors, "Service logs are not available, streaming containers one by one")
+		return conts
+	}
+
+	var order []string
+	services := map[string][]docker.APIContainers{}
+	rest := conts[:0:0]
+	for _, cont := range conts {
+		service := cont.Labels[swarmServiceNameKey]
+		if service == "" {
+			rest = append(rest, cont)
+			continue
+		}
+		if _, ok := services[service]; !ok {
+			order = append(order, service)
+		}
+		services[service] = append(services[service], cont)
+	}
+
+	for _, service := range order {
+		s.startService(ctx, sl, service, services[service])
+	}
+	return rest
+}
+
+// unitService reports whether cont belongs to a service streamed as a unit,
+// whose stream already carries cont's lines.
+func (s *streamer) unitService(cont docker.APIContainers) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.services[cont.Labels[swarmServiceNameKey]]
+	return ok && cont.Labels[swarmServiceNameKey] != ""
+}
+
+// startService streams service in the background, tagging each line by the
+// task it came from. conts are the service's known containers, naming tasks.
+func (s *streamer) startService(ctx context.Context, sl ServiceLogger, service string, conts []docker.APIContainers) {
+	ctx, cancel := s.graced(ctx)
+	s.mu.Lock()
+	s.services[service] = struct{}{}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		if err := s.sem.acquire(ctx); err != nil {
+			return
+		}
+		defer s.sem.release()
+
+		st := &streamStats{name: service, head: s.head(cancel)}
+		s.mu.Lock()
+		s.stats = append(s.stats, st)
+		s.started++
+		s.mu.Unlock()
+
+		if err := s.serviceLogs(ctx, sl, service, conts, st); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(s.opts.Errors, "Logger failed for service %s: %s\n", service, err)
+			s.mu.Lock()
+			st.err = err
+			s.failed++
+			s.mu.Unlock()
+			return
+		}
+
+		s.notice(service, streamTags{}, markExited, "exited")
+	}()
+}
+
+// serviceLogs attaches to service's logs once, returning when the stream
+// ends.
+func (s *streamer) serviceLogs(ctx context.Context, sl ServiceLogger, service string, conts []docker.APIContainers, st *streamStats) error {
+	tasks := newTaskWriters(s, service, conts, st)
+	outDemux := tasks.demux(false)
+	errDemux := tasks.demux(true)
+
+	err := sl.GetServiceLogs(docker.LogsServiceOptions{
+		Context:      ctx,
+		Service:      service,
+		Stdout:       !s.opts.NoStdout,
+		OutputStream: outDemux,
+		Stderr:       !s.opts.NoStderr,
+		ErrorStream:  errDemux,
+		Follow:       s.opts.Follow,
+		Tail:         s.opts.Tail,
+		Since:        s.opts.Since,
+		Timestamps:   s.opts.Timestamps,
+		// the task each line came from is only given in its details
+		Details: true,
+	})
+	outDemux.Close()
+	errDemux.Close()
+	tasks.close()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// taskWriters holds the per task streams a service's lines are handed to,
+// opened as each task is first seen.
+type taskWriters struct {
+	s       *streamer
+	service string
+	st      *streamStats
+
+	mu      sync.Mutex
+	known   map[string]docker.APIContainers
+	streams map[string]*taskStreams
+}
+
+type taskStreams struct {
+	out, err io.Writer
+	close    func()
+}
+
+func newTaskWriters(s *streamer, service string, conts []docker.APIContainers, st *streamStats) *taskWriters {
+	tw := &taskWriters{
+		s:       s,
+		service: service,
+		st:      st,
+		known:   map[string]docker.APIContainers{},
+		streams: map[string]*taskStreams{},
+	}
+	for _, cont := range conts {
+		if id := cont.Labels[swarmTaskIDKey]; id != "" {
+			tw.known[id] = cont
+		}
+	}
+	return tw
+}
+
+// task returns the streams of the task with id, opening them on first use.
+func (tw *taskWriters) task(id string) (*taskStreams, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if ts, ok := tw.streams[id]; ok {
+		return ts, nil
+	}
+
+	cont, ok := tw.known[id]
+	if !ok {
+		name := tw.service
+		if id != "" {
+			name += "." + shortID(id)
+		}
+		// a task on another node, or started since the containers were
+		// listed, is named by its ID as its slot is not known
+		cont = docker.APIContainers{
+			ID: id,
+			Labels: map[string]string{
+				swarmServiceNameKey: tw.service,
+				swarmTaskNameKey:    name,
+			},
+		}
+	}
+
+	var extra []LineOption
+	if tw.s.details() {
+		extra = append(extra, WithDetails())
+	}
+	out, errOut, closeStreams, err := tw.s.streams(cont, getTag(cont, tw.s.opts.TagLabel), tw.s.tagsFor(cont), tw.st, extra...)
+	if err != nil {
+		return nil, err
+	}
+	ts := &taskStreams{out: out, err: errOut, close: closeStreams}
+	tw.streams[id] = ts
+	return ts, nil
+}
+
+func (tw *taskWriters) close() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	for _, ts := range tw.streams {
+		ts.close()
+	}
+}
+
+// servicePrefixMax is the room left beyond Options.MaxLine for the timestamp
+// and details leading each line of a service's logs.
+const servicePrefixMax = 4096
+
+// demux returns a writer splitting a service's stdout, or stderr, into lines
+// and handing each to the streams of the task named in its details. Lines are
+// bounded as a LineWriter bounds them, those cut short are ended with the
+// truncation marker so the task's stream sees one line.
+func (tw *taskWriters) demux(stderr bool) io.WriteCloser {
+	r, in := io.Pipe()
+	pw := &pipeWriter{
+		PipeWriter: in,
+		done:       make(chan struct{}),
+	}
+
+	maxLine := tw.s.opts.MaxLine
+	if maxLine <= 0 {
+		maxLine = bufio.MaxScanTokenSize
+	}
+	maxLine += servicePrefixMax
+
+	go func() {
+		defer close(pw.done)
+
+		var truncated bool
+		scan := bufio.NewScanner(r)
+		scan.Buffer(make([]byte, 0, 4096), maxLine)
+		scan.Split(truncateLines(maxLine, scanLinesKeepCR, &truncated))
+		for scan.Scan() {
+			line := scan.Bytes()
+			if truncated {
+				line = append(append(line[:len(line):len(line)], truncatedMarker...), '\n')
+				truncated = false
+			}
+			if err := tw.route(line, stderr); err != nil {
+				r.CloseWithError(err)
+				return
+			}
+		}
+		if err := scan.Err(); err != nil {
+			r.CloseWithError(err)
+		}
+	}()
+
+	return pw
+}
+
+// route writes line to its task's stream, without the details naming the
+// task unless Options.Details asked for them.
+func (tw *taskWriters) route(line []byte, stderr bool) error {
+	var ts []byte
+	rest := line
+	if tw.s.opts.Timestamps {
+		if i := bytes.IndexByte(rest, ' '); i >= 0 {
+			ts, rest = rest[:i+1], rest[i+1:]
+		}
+	}
+
+	var raw []byte
+	if i := bytes.IndexByte(rest, ' '); i >= 0 {
+		raw = rest[:i+1]
+	}
+	details, msg := splitDetails(rest)
+
+	streams, err := tw.task(details[swarmTaskIDKey])
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, 0, len(line))
+	out = append(out, ts...)
+	if tw.s.details() {
+		out = append(out, raw...)
+	}
+	out = append(out, msg...)
+
+	w := streams.out
+	if stderr {
+		w = streams.err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,124 @@
+package dla_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// task is a running container of the swarm service's task slot.
+func task(id, service, slot string) docker.APIContainers {
+	return docker.APIContainers{
+		ID:    id,
+		Names: []string{"/" + service + "." + slot + "." + id},
+		Labels: map[string]string{
+			"com.docker.swarm.service.name": service,
+			"com.docker.swarm.task.name":    service + "." + slot + "." + id,
+			"com.docker.swarm.task.id":      id,
+		},
+	}
+}
+
+func TestServiceLogsDetails(t *testing.T) {
+	tests := []struct {
+		name    string
+		details bool
+	}{
+		{name: "hidden"},
+		{name: "shown", details: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(task("t1", "web", "1"))
+			client.SetOutput("t1", dlatest.Output{Stdout: "hello\n"})
+
+			var out syncBuffer
+			agg := dla.New(client, &out, dla.Options{ServiceLogs: true, Details: tt.details})
+			if err := agg.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(client.ServiceLogsCalls) != 1 || !client.ServiceLogsCalls[0].Details {
+				t.Fatalf("ServiceLogsCalls = %+v, want one call with Details", client.ServiceLogsCalls)
+			}
+			if len(client.LogsCalls) != 0 {
+				t.Errorf("LogsCalls = %+v, want none", client.LogsCalls)
+			}
+
+			got := out.String()
+			if !strings.Contains(got, "hello") {
+				t.Errorf("output missing the line:\n%s", got)
+			}
+			if shown := strings.Contains(got, "com.docker.swarm.task.id=t1"); shown != tt.details {
+				t.Errorf("details shown = %v, want %v:\n%s", shown, tt.details, got)
+			}
+		})
+	}
+}
+
+func TestServiceLogsMaxLine(t *testing.T) {
+	long := strings.Repeat("x", 20000)
+	client := dlatest.NewClient(task("t1", "web", "1"))
+	client.SetOutput("t1", dlatest.Output{Stdout: long + "\nnext\n"})
+
+	var out syncBuffer
+	agg := dla.New(client, &out, dla.Options{ServiceLogs: true, MaxLine: 100})
+	if err := agg.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.String())
+	}
+	if strings.Count(lines[0], "…[truncated]") != 1 || len(lines[0]) > 200 {
+		t.Errorf("long line not truncated to MaxLine: %d bytes %q", len(lines[0]), lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "next") {
+		t.Errorf("line after the long one = %q, want it to end in next", lines[1])
+	}
+}
+
+func TestServiceLogs(t *testing.T) {
+	client := dlatest.NewClient(task("t1", "web", "1"), task("t2", "web", "2"), container("p1", "plain"))
+	client.SetOutput("t1", dlatest.Output{Stdout: "from t1\n"})
+	client.SetOutput("t2", dlatest.Output{Stdout: "from t2\n", Stderr: "t2 failed\n"})
+	client.SetOutput("p1", dlatest.Output{Stdout: "from p1\n"})
+
+	var out syncBuffer
+	agg := dla.New(client, &out, dla.Options{ServiceLogs: true, Tail: "10", Format: dla.FormatJSON})
+	if err := agg.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if len(client.ServiceLogsCalls) != 1 {
+		t.Fatalf("got %d ServiceLogs calls, want 1", len(client.ServiceLogsCalls))
+	}
+	if call := client.ServiceLogsCalls[0]; call.Service != "web" || call.Tail != "10" || !call.Stdout || !call.Stderr {
+		t.Errorf("ServiceLogs call = %+v", call)
+	}
+	// containers outside of a swarm service are still streamed one by one
+	if len(client.LogsCalls) != 1 || client.LogsCalls[0].Container != "p1" {
+		t.Errorf("LogsCalls = %+v, want only p1", client.LogsCalls)
+	}
+
+	got := map[string]streamLine{}
+	for _, line := range decodeLines(t, out.String()) {
+		got[line.Message] = line
+	}
+	want := map[string]streamLine{
+		"from t1":   {Service: "web", Task: "web.1.t1", Container: "t1", Stream: "stdout", Message: "from t1"},
+		"from t2":   {Service: "web", Task: "web.2.t2", Container: "t2", Stream: "stdout", Message: "from t2"},
+		"t2 failed": {Service: "web", Task: "web.2.t2", Container: "t2", Stream: "stderr", Message: "t2 failed"},
+		"from p1":   {Task: "plain", Container: "p1", Stream: "stdout", Message: "from p1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %+v\nwant %+v", got, want)
+	}
+}
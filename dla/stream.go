@@ -0,0 +1,943 @@
+package dla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+var dim = color.New(color.Faint)
+
+// Markers lead lifecycle notices in FormatText, setting them apart from the
+// log lines around them.
+const (
+	markAttached     = "▶"
+	markExited       = "■"
+	markReconnecting = "↻"
+	markRemoved      = "✕"
+)
+
+// errRemoved ends the stream of a container removed while being streamed,
+// which is its end rather than a failure.
+var errRemoved = errors.New("container removed")
+
+// removed reports whether err is docker no longer finding a container.
+func removed(err error) bool {
+	var noSuch *docker.NoSuchContainer
+	var derr *docker.Error
+	return errors.As(err, &noSuch) || (errors.As(err, &derr) && derr.Status == http.StatusNotFound)
+}
+
+// streamer tracks the containers being streamed by one Aggregator.Stream
+// call.
+type streamer struct {
+	*Aggregator
+	tagFmt func(id, tag string) []byte
+	// errTagFmt formats stderr tags under ColorByStream, nil when they match
+	// stdout's.
+	errTagFmt func(id, tag string) []byte
+	merge     *Merger
+	limit     *lineLimit
+	// shutdown is the context given to Stream, whose end streams outlive by
+	// Options.ExitGrace.
+	shutdown context.Context
+
+	sem    semaphore
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	active map[string]context.CancelFunc
+	// services are the swarm services streamed as a unit
+	services map[string]struct{}
+	stats    []*streamStats
+	started  int
+	failed   int
+}
+
+// streamStats counts the lines one container's stream emitted.
+type streamStats struct {
+	name   string
+	stdout atomic.Uint64
+	stderr atomic.Uint64
+	err    error
+
+	// removed is set when the stream ended with its container's removal.
+	removed bool
+	// reconnects counts the times the stream was reattached after dropping
+	// and downtime the time it spent dropped.
+	reconnects int
+	downtime   time.Duration
+
+	// head is the stream's own line limit under Options.Head.
+	head *lineLimit
+}
+
+// result is how the stream ended for its summary, s.mu must be held.
+func (st *streamStats) result() string {
+	switch {
+	case st.err != nil:
+		return "error: " + st.err.Error()
+	case st.removed:
+		return "removed"
+	}
+	return "ok"
+}
+
+// Stream streams the logs of conts until every stream ends or ctx is
+// cancelled. Streams stopped by ctx are not treated as failures. With
+// Options.Watch containers matching sels that start later are streamed too.
+func (a *Aggregator) Stream(ctx context.Context, sels []Selector, conts []docker.APIContainers) error {
+	if a.client == nil || len(conts) <= 0 {
+		return nil
+	}
+	if err := a.checkVersion(); err != nil {
+		return err
+	}
+
+	s := &streamer{
+		Aggregator: a,
+		tagFmt:     tagConfig(getTags(conts, a.tagFields()), a.tagStyle(), a.colorPicker()),
+		active:     map[string]context.CancelFunc{},
+		services:   map[string]struct{}{},
+		sem:        newSemaphore(a.opts.Concurrency),
+		shutdown:   ctx,
+	}
+	if a.opts.ColorBy == ColorByStream {
+		s.tagFmt = tagConfig(getTags(conts, a.tagFields()), a.tagStyle(), fixedColor(streamColors.stdout))
+		s.errTagFmt = tagConfig(getTags(conts, a.tagFields()), a.tagStyle(), fixedColor(streamColors.stderr))
+	}
+
+	if a.opts.Merge > 0 {
+		s.merge = NewMerger(a.opts.Merge, 0)
+	}
+
+	if a.opts.MaxLines > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		s.limit = &lineLimit{max: uint64(a.opts.MaxLines), done: cancel}
+	}
+
+	if a.opts.Follow && a.opts.Concurrency > 0 && len(conts) > a.opts.Concurrency {
+		fmt.Fprintf(a.opts.Errors, "Following %d containers with a concurrency of %d, only %d will be streamed until others end\n", len(conts), a.opts.Concurrency, a.opts.Concurrency)
+	}
+
+	for _, cont := range s.startServices(ctx, conts) {
+		s.start(ctx, cont)
+	}
+
+	if a.opts.Follow && a.opts.Refresh > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.refresh(ctx, sels)
+		}()
+	}
+
+	if a.opts.Watch {
+		if err := s.watch(ctx, sels); err != nil {
+			fmt.Fprintf(a.opts.Errors, "Watching for new containers failed: %s\n", err)
+		}
+	}
+
+	s.wg.Wait()
+
+	if s.merge != nil {
+		if err := s.merge.Close(); err != nil {
+			fmt.Fprintf(a.opts.Errors, "Error writing merged lines: %s\n", err)
+		}
+	}
+
+	if a.opts.Summary {
+		s.summarize(a.opts.Errors)
+	}
+
+	if s.failed > 0 {
+		return fmt.Errorf("%d of %d log streams failed", s.failed, s.started)
+	}
+
+	return nil
+}
+
+// graced derives a stream's context from ctx. Once the context given to
+// Stream is done it lives on for Options.ExitGrace, letting the stream write
+// what docker already sent, while ctx ending for any other reason ends it at
+// once.
+func (s *streamer) graced(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.ExitGrace <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	graced, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		if s.shutdown.Err() == nil {
+			cancel()
+			return
+		}
+		time.AfterFunc(s.opts.ExitGrace, cancel)
+	})
+	return graced, func() {
+		stop()
+		cancel()
+	}
+}
+
+// start streams cont in the background unless it is already being streamed.
+// Failures are counted rather than exiting so the other streams keep running.
+func (s *streamer) start(ctx context.Context, cont docker.APIContainers) {
+	if s.unitService(cont) {
+		return
+	}
+
+	ctx, cancel := s.graced(ctx)
+	if !s.claim(cont.ID, cancel) {
+		cancel()
+		return
+	}
+
+	name := getTag(cont, s.opts.TagLabel)
+	tag := s.tagsFor(cont)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		if err := s.sem.acquire(ctx); err != nil {
+			s.release(cont.ID)
+			return
+		}
+		defer s.sem.release()
+
+		// a stream cancelled while waiting its turn never started, so it is
+		// neither counted nor summarized
+		st := &streamStats{name: name, head: s.head(cancel)}
+		s.mu.Lock()
+		s.stats = append(s.stats, st)
+		s.started++
+		s.mu.Unlock()
+
+		err := s.run(ctx, cont, name, tag, st)
+		if errors.Is(err, errRemoved) {
+			s.mu.Lock()
+			st.removed = true
+			s.mu.Unlock()
+			s.notice(name, tag, markRemoved, "removed")
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(s.opts.Errors, "Logger failed for %s: %s\n", name, err)
+			s.mu.Lock()
+			st.err = err
+			s.failed++
+			s.mu.Unlock()
+			return
+		}
+
+		s.notice(name, tag, markExited, "exited")
+	}()
+}
+
+// head is the line limit of a stream cancelled by cancel under Options.Head,
+// nil without one.
+func (s *streamer) head(cancel context.CancelFunc) *lineLimit {
+	if s.opts.Head <= 0 {
+		return nil
+	}
+	return &lineLimit{max: uint64(s.opts.Head), done: cancel}
+}
+
+// notice writes a lifecycle event of the stream of name to Info. In FormatText
+// it follows the stream's own tag and mark so it reads as part of that
+// stream, in other formats it is a plain sentence.
+func (s *streamer) notice(name string, tag streamTags, mark, event string) {
+	if s.opts.Raw || s.opts.Format != FormatText || tag.out == nil {
+		fmt.Fprintln(s.info, dim.Sprintf("Stream %s %s", name, event))
+		return
+	}
+
+	note := mark + " " + dim.Sprint("stream "+event)
+	var line []byte
+	if s.opts.TagPosition == PositionAfter {
+		line = append(append([]byte(note), tag.out...), '\n')
+	} else {
+		line = append(append(append([]byte(nil), tag.out...), note...), '\n')
+	}
+	s.info.Write(line)
+}
+
+// colorPicker chooses how containers' tags are colored.
+func (a *Aggregator) colorPicker() colorPicker {
+	switch a.opts.ColorBy {
+	case ColorByStream:
+		return nil
+	case ColorByIndex:
+		return indexColors(a.opts.Palette)
+	default:
+		return hashColors(a.opts.Palette)
+	}
+}
+
+// streamTags holds the prefixes of a container's stdout and stderr lines.
+type streamTags struct {
+	out []byte
+	err []byte
+}
+
+func (a *Aggregator) tagStyle() tagStyle {
+	return tagStyle{
+		sep:        a.opts.Separator,
+		alignRight: a.opts.Align == AlignRight,
+		max:        a.opts.MaxTag,
+		after:      a.opts.TagPosition == PositionAfter,
+	}
+}
+
+func (a *Aggregator) tagFields() tagFields {
+	return tagFields{id: a.opts.ShowID, node: a.opts.ShowNode, label: a.opts.TagLabel}
+}
+
+// tagsFor resolves cont's formatted tags. It is called once as a stream is
+// attached, LineWriter being handed the bytes themselves so lines never go
+// through tagFmt's lookup.
+func (s *streamer) tagsFor(cont docker.APIContainers) streamTags {
+	tag := displayTag(cont, s.tagFields())
+	out := s.tagFmt(cont.ID, tag)
+	if s.errTagFmt == nil {
+		return streamTags{out: out, err: out}
+	}
+	return streamTags{out: out, err: s.errTagFmt(cont.ID, tag)}
+}
+
+// List writes the containers Stream would stream for conts to w, one row
+// each with the tag it would be printed under, without attaching to any.
+func (a *Aggregator) List(w io.Writer, conts []docker.APIContainers) error {
+	style := a.tagStyle()
+	style.sep, style.after = "", false
+	tagFmt := tagConfig(getTags(conts, a.tagFields()), style, a.colorPicker())
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tTASK\tID\tTAG")
+	for _, cont := range conts {
+		service := serviceName(cont)
+		if service == "" {
+			service = "-"
+		}
+		// the tag goes last as its color codes would throw out the columns
+		// after it
+		tag := tagFmt(cont.ID, displayTag(cont, a.tagFields()))
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", service, getTag(cont, ""), shortID(cont.ID), tag)
+	}
+	return tw.Flush()
+}
+
+// summarize writes the line counts, reconnects, downtime and outcome of
+// every stream to w.
+func (s *streamer) summarize(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := append([]*streamStats(nil), s.stats...)
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].name < stats[j].name
+	})
+
+	if jm, ok := w.(*jsonMessages); ok {
+		// one object per stream rather than a table of messages
+		for _, st := range stats {
+			summary := jsonSummary{
+				Level:      "info",
+				Stream:     st.name,
+				Stdout:     st.stdout.Load(),
+				Stderr:     st.stderr.Load(),
+				Reconnects: st.reconnects,
+				Downtime:   st.downtime.Seconds(),
+				Result:     st.result(),
+			}
+			jm.object(summary)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tSTDOUT\tSTDERR\tRECONNECTS\tDOWNTIME\tRESULT")
+	for _, st := range stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\n", st.name, st.stdout.Load(), st.stderr.Load(), st.reconnects, st.downtime.Round(100*time.Millisecond), st.result())
+	}
+	tw.Flush()
+}
+
+// jsonSummary is a stream's summary line under FormatJSON, its downtime given
+// in seconds.
+type jsonSummary struct {
+	Level      string  `json:"level"`
+	Stream     string  `json:"stream"`
+	Stdout     uint64  `json:"stdout"`
+	Stderr     uint64  `json:"stderr"`
+	Reconnects int     `json:"reconnects"`
+	Downtime   float64 `json:"downtime"`
+	Result     string  `json:"result"`
+}
+
+// semaphore bounds how many callers may hold it at once, a nil semaphore
+// never blocks.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire blocks until the semaphore is available or ctx is done.
+func (sem semaphore) acquire(ctx context.Context) error {
+	if sem == nil {
+		return nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sem semaphore) release() {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// claim marks id as being streamed, reporting false if it already is.
+func (s *streamer) claim(id string, cancel context.CancelFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[id]; ok {
+		return false
+	}
+	s.active[id] = cancel
+	return true
+}
+
+// handover moves the stream of from over to to, reporting false if to is
+// already being streamed.
+func (s *streamer) handover(from, to string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[to]; ok {
+		return false
+	}
+	s.active[to] = s.active[from]
+	delete(s.active, from)
+	return true
+}
+
+func (s *streamer) release(id string) {
+	s.mu.Lock()
+	delete(s.active, id)
+	s.mu.Unlock()
+}
+
+// stop cancels the stream of id, if any.
+func (s *streamer) stop(id string) {
+	s.mu.Lock()
+	cancel, ok := s.active[id]
+	s.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// watch follows the docker events stream until ctx is done, starting streams
+// for containers matching sels as they start and stopping them on removal.
+func (s *streamer) watch(ctx context.Context, sels []Selector) error {
+	listener := make(chan *docker.APIEvents, 16)
+	err := s.client.AddEventListenerWithOptions(docker.EventsOptions{
+		Filters: map[string][]string{
+			"type":  []string{"container"},
+			"event": []string{"start", "destroy"},
+		},
+	}, listener)
+	if err != nil {
+		return err
+	}
+	defer s.client.RemoveEventListener(listener)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-listener:
+			if !ok {
+				return fmt.Errorf("event stream closed")
+			}
+			// events queued as ctx ended must not start streams
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// older daemons only fill in the deprecated fields
+			id, action := ev.Actor.ID, ev.Action
+			if id == "" {
+				id = ev.ID
+			}
+			if action == "" {
+				action = ev.Status
+			}
+
+			switch action {
+			case "start":
+				if err := s.attach(ctx, sels, id); err != nil {
+					fmt.Fprintf(s.opts.Errors, "Unable to attach to started container %s: %s\n", id, err)
+				}
+			case "destroy":
+				s.stop(id)
+			}
+		}
+	}
+}
+
+// refresh re-resolves sels every Options.Refresh until ctx is done, starting
+// streams for newly matched containers and stopping those no longer listed.
+func (s *streamer) refresh(ctx context.Context, sels []Selector) {
+	tick := time.NewTicker(s.opts.Refresh)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		conts, err := s.Containers(sels...)
+		if err != nil {
+			fmt.Fprintf(s.opts.Errors, "Refreshing containers failed: %s\n", err)
+			continue
+		}
+
+		listed := make(map[string]struct{}, len(conts))
+		for _, cont := range conts {
+			listed[cont.ID] = struct{}{}
+			s.start(ctx, cont)
+		}
+
+		s.mu.Lock()
+		var vanished []string
+		for id := range s.active {
+			if _, ok := listed[id]; !ok {
+				vanished = append(vanished, id)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, id := range vanished {
+			s.stop(id)
+		}
+	}
+}
+
+// attach starts streaming the container id if it matches sels.
+func (s *streamer) attach(ctx context.Context, sels []Selector, id string) error {
+	conts, err := s.Containers(sels...)
+	if err != nil {
+		return err
+	}
+
+	for _, cont := range conts {
+		if cont.ID == id {
+			s.start(ctx, cont)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// run streams cont's logs. While following, a dropped stream is re-resolved
+// and reattached with exponential backoff until Options.Reconnect consecutive
+// attempts fail, an attempt counting as a success once the stream stays up
+// for reconnectMaxDelay.
+func (s *streamer) run(ctx context.Context, cont docker.APIContainers, name string, tag streamTags, st *streamStats) error {
+	defer func() {
+		s.release(cont.ID)
+	}()
+
+	since := s.opts.Since
+	if s.opts.SinceStart {
+		since = s.startedAt(ctx, cont)
+	}
+	delay := reconnectBaseDelay
+
+	for attempt := 0; ; attempt++ {
+		if s.opts.Follow {
+			s.notice(name, tag, markAttached, "attached")
+		}
+		started := time.Now()
+		err := s.logs(ctx, cont, name, tag, st, since)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// a stopped container's logs simply end, there is nothing to
+		// reconnect to, nor is there once Until has passed
+		if !s.opts.Follow || !running(cont) || s.pastUntil() {
+			return err
+		}
+
+		// a removed container that nothing replaces ends as removed rather
+		// than failing
+		gone := errors.Is(err, errRemoved)
+		dropped := time.Now()
+
+		// only pick up from where this stream left off
+		since = time.Now().Unix()
+		if time.Since(started) >= reconnectMaxDelay {
+			attempt, delay = 0, reconnectBaseDelay
+		}
+
+		for {
+			if attempt >= s.opts.Reconnect {
+				s.down(st, dropped, false)
+				if gone {
+					return errRemoved
+				}
+				if err == nil || attempt == 0 {
+					return err
+				}
+				return fmt.Errorf("giving up after %d reconnect attempts: %s", attempt, err)
+			}
+
+			s.notice(name, tag, markReconnecting, fmt.Sprintf("dropped, reconnecting in %s (%d/%d)", delay, attempt+1, s.opts.Reconnect))
+			select {
+			case <-ctx.Done():
+				s.down(st, dropped, false)
+				return nil
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+
+			var next *docker.APIContainers
+			next, err = s.resolve(cont)
+			if err == nil && next == nil {
+				err = fmt.Errorf("no running container found")
+			}
+			if err == nil {
+				// the replacement may already be streamed, e.g. by -watch
+				if next.ID != cont.ID && !s.handover(cont.ID, next.ID) {
+					s.down(st, dropped, false)
+					return nil
+				}
+				cont = *next
+				tag = s.tagsFor(cont)
+				s.down(st, dropped, true)
+				break
+			}
+			attempt++
+		}
+	}
+}
+
+// down adds the time since dropped to st's downtime, counting a reconnect
+// when the stream was reattached.
+func (s *streamer) down(st *streamStats, dropped time.Time, reattached bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.downtime += time.Since(dropped)
+	if reattached {
+		st.reconnects++
+	}
+}
+
+// logs attaches to cont's logs once, returning when the stream ends. Docker
+// is not told of Options.Until, the lines after it are dropped here and the
+// stream ended once one arrives or, when following, the moment passes.
+func (s *streamer) logs(ctx context.Context, cont docker.APIContainers, name string, tag streamTags, st *streamStats, since int64) error {
+	parent := ctx
+	var until time.Time
+	var cancel context.CancelFunc
+	if s.opts.Until != 0 {
+		until = time.Unix(s.opts.Until, 0)
+		ctx, cancel = context.WithDeadline(ctx, until)
+		defer cancel()
+	}
+
+	// a one-shot read of a running container follows it for the grace, up
+	// to the lines logged once the read began, so that what the daemon was
+	// still flushing at the end of its logs is not lost
+	follow := s.opts.Follow
+	var idle *time.Timer
+	if !follow && s.opts.EOFGrace > 0 && running(cont) {
+		follow = true
+		if begun := time.Now(); until.IsZero() || begun.Before(until) {
+			until = begun
+		}
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		idle = time.AfterFunc(s.opts.EOFGrace, cancel)
+		defer idle.Stop()
+	}
+
+	var extra []LineOption
+	if !until.IsZero() && !s.opts.Raw {
+		extra = append(extra, withUntil(until, cancel))
+	}
+
+	outStream, errStream, closeStreams, err := s.streams(cont, name, tag, st, extra...)
+	if err != nil {
+		return err
+	}
+	if idle != nil {
+		outStream = idleWriter{outStream, idle, s.opts.EOFGrace}
+		errStream = idleWriter{errStream, idle, s.opts.EOFGrace}
+	}
+
+	err = s.client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    cont.ID,
+		Stdout:       !s.opts.NoStdout,
+		OutputStream: outStream,
+		Stderr:       !s.opts.NoStderr,
+		ErrorStream:  errStream,
+		Follow:       follow,
+		Tail:         s.opts.Tail,
+		Since:        since,
+		// the lines are told apart from those past Until by their
+		// timestamps
+		Timestamps: s.opts.Timestamps || (!until.IsZero() && !s.opts.Raw),
+	})
+	// wait for any buffered lines to be written before reporting
+	closeStreams()
+	if ctx.Err() != nil && parent.Err() == nil {
+		// ended by Until or the grace rather than by the caller
+		return nil
+	}
+	if removed(err) {
+		return errRemoved
+	}
+	if errors.Is(err, io.EOF) || (errors.Is(err, io.ErrUnexpectedEOF) && !running(cont)) {
+		// the daemon closing the stream of a stopped container is its end
+		return nil
+	}
+	return err
+}
+
+// idleWriter restarts timer for another grace on every write to w.
+type idleWriter struct {
+	w     io.Writer
+	timer *time.Timer
+	grace time.Duration
+}
+
+func (iw idleWriter) Write(b []byte) (int, error) {
+	iw.timer.Reset(iw.grace)
+	return iw.w.Write(b)
+}
+
+// pastUntil reports whether Options.Until has passed, after which streams
+// are not reattached.
+func (s *streamer) pastUntil() bool {
+	return s.opts.Until != 0 && !time.Now().Before(time.Unix(s.opts.Until, 0))
+}
+
+// streams builds the writers cont's stdout and stderr are copied to, adding
+// extra to the line options of both. closeStreams must be called once the
+// source is done, flushing any lines still held.
+func (s *streamer) streams(cont docker.APIContainers, name string, tag streamTags, st *streamStats, extra ...LineOption) (outStream, errStream io.Writer, closeStreams func(), err error) {
+	outOpts := append(s.lineOpts[:len(s.lineOpts):len(s.lineOpts)], WithCounter(&st.stdout))
+	errOpts := append(s.lineOpts[:len(s.lineOpts):len(s.lineOpts)], WithCounter(&st.stderr))
+	outOpts = append(outOpts, extra...)
+	errOpts = append(errOpts, extra...)
+	if s.merge != nil {
+		outOpts = append(outOpts, WithMerge(s.merge))
+		errOpts = append(errOpts, WithMerge(s.merge))
+	}
+	// the stream's own limit comes first so that lines past it are not
+	// counted against the limit of every stream
+	for _, l := range []*lineLimit{st.head, s.limit} {
+		if l != nil {
+			outOpts = append(outOpts, withLineLimit(l))
+			errOpts = append(errOpts, withLineLimit(l))
+		}
+	}
+
+	outInfo := StreamInfo{
+		Service:   serviceName(cont),
+		Task:      name,
+		Container: cont.ID,
+		Stream:    "stdout",
+	}
+	errInfo := outInfo
+	errInfo.Stream = "stderr"
+
+	// closers run in order once both streams are closed
+	var closers []func()
+	out, errOut := s.out, s.errOut
+	if s.opts.Format == FormatSyslog {
+		var closeSyslog func() error
+		out, errOut, closeSyslog, err = dialSyslog(s.opts.SyslogAddr, name)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("connecting to syslog: %s", err)
+		}
+		closers = append(closers, func() { closeSyslog() })
+	}
+	if s.opts.Buffer > 0 {
+		// queue this container's lines so a slow destination holds up only
+		// its own streams
+		queues := []*queueWriter{newQueueWriter(out, s.opts.Buffer, s.opts.DropOldest)}
+		if errOut != out {
+			queues = append(queues, newQueueWriter(errOut, s.opts.Buffer, s.opts.DropOldest))
+		}
+		out, errOut = queues[0], queues[len(queues)-1]
+		closers = append([]func(){func() {
+			var dropped uint64
+			for _, q := range queues {
+				q.Close()
+				dropped += q.dropped.Load()
+			}
+			if dropped > 0 {
+				fmt.Fprintf(s.opts.Errors, "Dropped %d lines from %s, output fell behind\n", dropped, name)
+			}
+		}}, closers...)
+	}
+
+	var outWC, errWC io.WriteCloser
+	switch {
+	case s.opts.Raw:
+		outWC = RawWriter(out)
+		errWC = RawWriter(errOut)
+	case s.opts.Format == FormatJSON:
+		// both streams share one writer, the stream field tells them apart
+		outWC = JSONLineWriter(out, outInfo, outOpts...)
+		errWC = JSONLineWriter(out, errInfo, errOpts...)
+	case s.opts.Format == FormatLogfmt:
+		outWC = LogfmtLineWriter(out, outInfo, outOpts...)
+		errWC = LogfmtLineWriter(out, errInfo, errOpts...)
+	case s.opts.Format == FormatSyslog:
+		// syslog tags and timestamps each message itself
+		outWC = NewLineWriter(out, nil, nil, outOpts...)
+		errWC = NewLineWriter(errOut, nil, nil, errOpts...)
+	default:
+		if s.opts.Template != nil {
+			outOpts = append(outOpts, WithTemplate(s.opts.Template, outInfo))
+			errOpts = append(errOpts, WithTemplate(s.opts.Template, errInfo))
+		}
+		outWC = NewLineWriter(out, tag.out, nil, outOpts...)
+		errWC = NewLineWriter(errOut, tag.err, s.errColor, errOpts...)
+	}
+
+	return outWC, errWC, func() {
+		outWC.Close()
+		errWC.Close()
+		for _, closer := range closers {
+			closer()
+		}
+	}, nil
+}
+
+// startedAt is when cont last started in Unix seconds, Options.Since when
+// that cannot be told.
+func (s *streamer) startedAt(ctx context.Context, cont docker.APIContainers) int64 {
+	ci, ok := s.client.(ContainerInspector)
+	if !ok {
+		return s.opts.Since
+	}
+
+	info, err := ci.InspectContainerWithOptions(docker.InspectContainerOptions{
+		Context: ctx,
+		ID:      cont.ID,
+	})
+	if err != nil || info == nil || info.State.StartedAt.IsZero() {
+		return s.opts.Since
+	}
+	return info.State.StartedAt.Unix()
+}
+
+// running reports whether cont was running when listed, containers listed
+// without a state are assumed to be.
+func running(cont docker.APIContainers) bool {
+	return cont.State == "" || cont.State == "running"
+}
+
+// resolve finds the running container now standing in for cont. Swarm tasks
+// are replaced by a new task in the same slot, so those are matched by
+// service and slot, and recreated compose containers by project, service and
+// number. Anything else is expected to come back with the same ID.
+func (s *streamer) resolve(cont docker.APIContainers) (*docker.APIContainers, error) {
+	service := cont.Labels[swarmServiceNameKey]
+	task := cont.Labels[swarmTaskNameKey]
+	project := cont.Labels[composeProjectKey]
+	number := cont.Labels[composeNumberKey]
+
+	filters := map[string][]string{
+		"id": []string{cont.ID},
+	}
+	same := func(docker.APIContainers) bool { return true }
+	switch {
+	case service != "" && task != "":
+		filters = map[string][]string{
+			"label": []string{swarmServiceNameKey + "=" + service},
+		}
+		slot := taskSlot(task)
+		same = func(next docker.APIContainers) bool {
+			return taskSlot(next.Labels[swarmTaskNameKey]) == slot
+		}
+	case project != "" && number != "":
+		filters = map[string][]string{
+			"label": []string{
+				composeProjectKey + "=" + project,
+				composeServiceKey + "=" + cont.Labels[composeServiceKey],
+			},
+		}
+		same = func(next docker.APIContainers) bool {
+			return next.Labels[composeNumberKey] == number
+		}
+	}
+
+	conts, err := s.client.ListContainers(docker.ListContainersOptions{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range conts {
+		if same(conts[i]) {
+			return &conts[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// taskSlot trims the task ID from a swarm task name (service.slot.id), leaving
+// the part shared by every task that fills the same slot.
+func taskSlot(task string) string {
+	if i := strings.LastIndexByte(task, '.'); i >= 0 {
+		return task[:i]
+	}
+	return task
+}
@@ -0,0 +1,860 @@
+package dla_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of an
+// Aggregator's streams.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// container is a running container named name.
+func container(id, name string) docker.APIContainers {
+	return docker.APIContainers{ID: id, Names: []string{"/" + name}}
+}
+
+func TestUntil(t *testing.T) {
+	until := time.Date(2020, 1, 1, 0, 0, 2, 0, time.UTC)
+	stdout := "2020-01-01T00:00:01.000000000Z one\n" +
+		"2020-01-01T00:00:02.000000000Z two\n" +
+		"2020-01-01T00:00:03.000000000Z three\n" +
+		"2020-01-01T00:00:04.000000000Z four\n"
+
+	tests := []struct {
+		name       string
+		timestamps bool
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:    "hides the stamps it asked for",
+			want:    []string{"one", "two"},
+			notWant: []string{"three", "four", "2020-01-01"},
+		},
+		{
+			name:       "keeps requested stamps",
+			timestamps: true,
+			want:       []string{"one", "two", "2020-01-01"},
+			notWant:    []string{"three", "four"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{Stdout: stdout})
+
+			var out syncBuffer
+			agg := dla.New(client, &out, dla.Options{
+				Until:      until.Unix(),
+				Timestamps: tt.timestamps,
+			})
+			if err := agg.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			got := out.String()
+			for _, s := range tt.want {
+				if !strings.Contains(got, s) {
+					t.Errorf("output missing %q:\n%s", s, got)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(got, s) {
+					t.Errorf("output contains %q:\n%s", s, got)
+				}
+			}
+			if len(client.LogsCalls) != 1 || !client.LogsCalls[0].Timestamps {
+				t.Errorf("LogsCalls = %+v, want one call with Timestamps", client.LogsCalls)
+			}
+		})
+	}
+}
+
+func TestUntilEndsFollow(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "2020-01-01T00:00:01.000000000Z one\n"})
+
+	var out syncBuffer
+	agg := dla.New(client, &out, dla.Options{
+		Follow: true,
+		Until:  time.Now().Add(time.Second).Unix(),
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() still following after Until passed")
+	}
+	if got := out.String(); !strings.Contains(got, "one") {
+		t.Errorf("output missing the line before Until:\n%s", got)
+	}
+}
+
+func TestRunStreamError(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "ok"), container("b1", "broken"), container("c1", "fine"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "from ok\n"})
+	client.SetOutput("b1", dlatest.Output{Stdout: "from broken\n", Err: errors.New("boom")})
+	client.SetOutput("c1", dlatest.Output{Stdout: "from fine\n"})
+
+	var out, errs syncBuffer
+	agg := dla.New(client, &out, dla.Options{Errors: &errs})
+	err := agg.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Errorf("Run() error = %v, want one of three streams failed", err)
+	}
+	if !strings.Contains(errs.String(), "boom") {
+		t.Errorf("errors missing the failed stream's:\n%s", errs.String())
+	}
+
+	got := out.String()
+	for _, want := range []string{"from ok", "from broken", "from fine"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+// summaryLine is a FormatJSON summary object as the tests inspect it.
+type summaryLine struct {
+	Stream     string  `json:"stream"`
+	Stdout     uint64  `json:"stdout"`
+	Stderr     uint64  `json:"stderr"`
+	Reconnects int     `json:"reconnects"`
+	Downtime   float64 `json:"downtime"`
+	Result     string  `json:"result"`
+}
+
+// decodeSummary decodes the summary objects in out by stream, skipping any
+// other messages.
+func decodeSummary(t *testing.T, out string) map[string]summaryLine {
+	t.Helper()
+
+	got := map[string]summaryLine{}
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var line summaryLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("decoding %q: %v", out, err)
+		}
+		if line.Result != "" {
+			got[line.Stream] = line
+		}
+	}
+	return got
+}
+
+func TestRunSummary(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"), container("b1", "broken"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "one\ntwo\nthree\n", Stderr: "oops\n"})
+	client.SetOutput("b1", dlatest.Output{Stdout: "from broken\n", Err: errors.New("boom")})
+
+	var out, errs syncBuffer
+	agg := dla.New(client, &out, dla.Options{Summary: true, Errors: &errs, Format: dla.FormatJSON})
+	if err := agg.Run(context.Background()); err == nil {
+		t.Fatal("Run() error = nil, want the broken stream's")
+	}
+
+	want := map[string]summaryLine{
+		"web":    {Stream: "web", Stdout: 3, Stderr: 1, Result: "ok"},
+		"broken": {Stream: "broken", Stdout: 1, Result: "error: boom"},
+	}
+	if got := decodeSummary(t, errs.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestList(t *testing.T) {
+	client := fleet()
+	agg := dla.New(client, nil, dla.Options{})
+	conts, err := agg.Containers(dla.NameSelector("web"), dla.ComposeSelector("db"))
+	if err != nil {
+		t.Fatalf("Containers() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := agg.List(&out, conts); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := "SERVICE  TASK       ID  TAG\n" +
+		"web      web.1.w1   w1  web.1.w1 \n" +
+		"web      web.2.w2   w2  web.2.w2 \n" +
+		"db       shop-db-1  c1  shop-db-1\n"
+	if got := out.String(); got != want {
+		t.Errorf("List() wrote %q, want %q", got, want)
+	}
+	if len(client.LogsCalls) != 0 {
+		t.Errorf("got %d Logs calls, want none", len(client.LogsCalls))
+	}
+}
+
+func TestRunNoContainers(t *testing.T) {
+	agg := dla.New(dlatest.NewClient(), nil, dla.Options{})
+	if err := agg.Run(context.Background(), dla.NameSelector("web")); !errors.Is(err, dla.ErrNoContainers) {
+		t.Errorf("Run() error = %v, want %v", err, dla.ErrNoContainers)
+	}
+}
+
+// streamLine is a FormatJSON line as the tests inspect it.
+type streamLine struct {
+	Service   string `json:"service"`
+	Task      string `json:"task"`
+	Container string `json:"container"`
+	Stream    string `json:"stream"`
+	Message   string `json:"message"`
+}
+
+// decodeLines decodes the FormatJSON output out.
+func decodeLines(t *testing.T, out string) []streamLine {
+	t.Helper()
+
+	var lines []streamLine
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var line streamLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("decoding %q: %v", out, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// waitFor polls cond until it holds, failing t after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunReconnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		drops     int
+		reconnect int
+		wantErr   string
+		wantLogs  int
+	}{
+		{name: "disabled", drops: 1, reconnect: 0, wantErr: "1 of 1 log streams failed", wantLogs: 1},
+		{name: "reattaches", drops: 1, reconnect: 2, wantLogs: 2},
+		{name: "gives up", drops: 3, reconnect: 1, wantErr: "1 of 1 log streams failed", wantLogs: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{Stdout: "line\n", Drops: tt.drops})
+
+			var out, errs syncBuffer
+			agg := dla.New(client, &out, dla.Options{
+				Follow:    true,
+				Reconnect: tt.reconnect,
+				Format:    dla.FormatJSON,
+				Errors:    &errs,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(ctx) }()
+
+			// a stream still up once reattached is followed until canceled
+			if tt.wantErr == "" {
+				waitFor(t, "the reattached stream", func() bool {
+					return len(decodeLines(t, out.String())) == tt.wantLogs
+				})
+				cancel()
+			}
+
+			err := <-done
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Run() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Run() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			if len(client.LogsCalls) != tt.wantLogs {
+				t.Fatalf("got %d Logs calls, want %d", len(client.LogsCalls), tt.wantLogs)
+			}
+			for i, call := range client.LogsCalls[1:] {
+				if !call.Follow || call.Since == 0 {
+					t.Errorf("reattach %d = Follow %v Since %d, want it following from the drop", i+1, call.Follow, call.Since)
+				}
+			}
+		})
+	}
+}
+
+func TestRunReconnectSummary(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "line\n", Drops: 2})
+
+	var out, errs syncBuffer
+	agg := dla.New(client, &out, dla.Options{
+		Follow:    true,
+		Reconnect: 3,
+		Summary:   true,
+		Errors:    &errs,
+		Format:    dla.FormatJSON,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(ctx) }()
+
+	waitFor(t, "the second reattach", func() bool {
+		return len(decodeLines(t, out.String())) == 3
+	})
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got := decodeSummary(t, errs.String())["web"]
+	if got.Reconnects != 2 || got.Stdout != 3 || got.Result != "ok" {
+		t.Errorf("summary = %+v, want 2 reconnects and 3 lines", got)
+	}
+	// the backoff alone keeps it down for a second and then two
+	if got.Downtime < 3 {
+		t.Errorf("summary downtime = %gs, want at least 3s", got.Downtime)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    dla.Options
+		timeout time.Duration
+		want    map[string]int
+	}{
+		{
+			name:    "a deadline ends following",
+			opts:    dla.Options{Follow: true},
+			timeout: 50 * time.Millisecond,
+			want:    map[string]int{"a1": 5, "b1": 5},
+		},
+		{
+			name: "max lines across every stream",
+			opts: dla.Options{Follow: true, MaxLines: 3},
+			want: map[string]int{"": 3},
+		},
+		{
+			name: "head of each stream",
+			opts: dla.Options{Head: 2},
+			want: map[string]int{"a1": 2, "b1": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"), container("b1", "api"))
+			lines := strings.Repeat("line\n", 5)
+			client.SetOutput("a1", dlatest.Output{Stdout: lines})
+			client.SetOutput("b1", dlatest.Output{Stdout: lines})
+
+			var out syncBuffer
+			opts := tt.opts
+			opts.Format = dla.FormatJSON
+			agg := dla.New(client, &out, opts)
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(ctx) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return once the limit was reached")
+			}
+
+			got := map[string]int{}
+			for _, line := range decodeLines(t, out.String()) {
+				if _, ok := tt.want[""]; ok {
+					line.Container = ""
+				}
+				got[line.Container]++
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines per container = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinceStart(t *testing.T) {
+	started := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := dlatest.NewClient(container("a1", "web"), container("b1", "api"))
+	client.SetStarted("a1", started)
+
+	agg := dla.New(client, &syncBuffer{}, dla.Options{SinceStart: true, Since: 1577836800})
+	if err := agg.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// b1's start time is unknown, so it falls back to Since
+	got := map[string]int64{}
+	for _, call := range client.LogsCalls {
+		got[call.Container] = call.Since
+	}
+	if want := map[string]int64{"a1": started.Unix(), "b1": 1577836800}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Since per container = %v, want %v", got, want)
+	}
+}
+
+func TestRunRemoved(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "no such container", err: &docker.NoSuchContainer{ID: "a1"}},
+		{name: "not found", err: &docker.Error{Status: http.StatusNotFound, Message: "No such container: a1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"), container("b1", "api"))
+			client.SetOutput("a1", dlatest.Output{Stdout: "from a1\n", Err: tt.err})
+			client.SetOutput("b1", dlatest.Output{Stdout: "from b1\n"})
+
+			var out, info, errs syncBuffer
+			agg := dla.New(client, &out, dla.Options{Follow: true, Summary: true, Info: &info, Errors: &errs})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(ctx) }()
+
+			waitFor(t, "the removal", func() bool {
+				return strings.Contains(info.String(), "stream removed")
+			})
+			// the other stream is still followed
+			if !strings.Contains(out.String(), "from b1") {
+				t.Errorf("output missing b1's line:\n%s", out.String())
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run() error = %v, want a removal not to fail the run", err)
+			}
+
+			if strings.Contains(errs.String(), "Logger failed") {
+				t.Errorf("removal reported as a failure:\n%s", errs.String())
+			}
+			if !regexp.MustCompile(`(?m)^web .* removed$`).MatchString(errs.String()) {
+				t.Errorf("summary does not show web removed:\n%s", errs.String())
+			}
+		})
+	}
+}
+
+func TestStreamSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       dla.Options
+		wantStdout bool
+		wantStderr bool
+	}{
+		{name: "both", wantStdout: true, wantStderr: true},
+		{name: "stdout only", opts: dla.Options{NoStderr: true}, wantStdout: true},
+		{name: "stderr only", opts: dla.Options{NoStdout: true}, wantStderr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{Stdout: "to stdout\n", Stderr: "to stderr\n"})
+
+			var out syncBuffer
+			if err := dla.New(client, &out, tt.opts).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(client.LogsCalls) != 1 {
+				t.Fatalf("Logs called %d times, want once", len(client.LogsCalls))
+			}
+			if call := client.LogsCalls[0]; call.Stdout != tt.wantStdout || call.Stderr != tt.wantStderr {
+				t.Errorf("LogsOptions Stdout %v Stderr %v, want %v and %v", call.Stdout, call.Stderr, tt.wantStdout, tt.wantStderr)
+			}
+			if got := strings.Contains(out.String(), "to stdout"); got != tt.wantStdout {
+				t.Errorf("stdout printed %v, want %v:\n%s", got, tt.wantStdout, out.String())
+			}
+			if got := strings.Contains(out.String(), "to stderr"); got != tt.wantStderr {
+				t.Errorf("stderr printed %v, want %v:\n%s", got, tt.wantStderr, out.String())
+			}
+		})
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"), container("b1", "api"), container("c1", "db"))
+	for _, id := range []string{"a1", "b1", "c1"} {
+		client.SetOutput(id, dlatest.Output{Stdout: "from " + id + "\n"})
+	}
+
+	var out, summary syncBuffer
+	agg := dla.New(client, &out, dla.Options{Follow: true, Concurrency: 2, Summary: true, Errors: &summary, Format: dla.FormatJSON})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(ctx) }()
+
+	waitFor(t, "two streams", func() bool {
+		return strings.Count(out.String(), "from ") == 2
+	})
+	// the third waits its turn as long as the other two follow
+	time.Sleep(50 * time.Millisecond)
+	if n := strings.Count(out.String(), "from "); n != 2 {
+		t.Errorf("%d streams ran at once, want 2:\n%s", n, out.String())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// nor is the stream that never got its turn summarized
+	if n := strings.Count(summary.String(), `"stream":`); n != 2 {
+		t.Errorf("summary has %d streams, want 2:\n%s", n, summary.String())
+	}
+}
+
+func TestRunWatch(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "from a1\n"})
+	client.SetOutput("b1", dlatest.Output{Stdout: "from b1\n"})
+
+	var out syncBuffer
+	agg := dla.New(client, &out, dla.Options{Follow: true, Watch: true, Format: dla.FormatJSON})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(ctx) }()
+
+	waitFor(t, "the listed container", func() bool {
+		return strings.Contains(out.String(), "from a1")
+	})
+
+	client.AddContainer(container("b1", "worker"))
+	// the listener may not be registered yet, so keep announcing the start
+	waitFor(t, "the started container", func() bool {
+		client.Emit(ctx, &docker.APIEvents{Action: "start", Actor: docker.APIActor{ID: "b1"}})
+		return strings.Contains(out.String(), "from b1")
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	streamed := map[string]int{}
+	for _, line := range decodeLines(t, out.String()) {
+		streamed[line.Container]++
+	}
+	if streamed["a1"] != 1 || streamed["b1"] != 1 {
+		t.Errorf("lines per container = %v, want one each", streamed)
+	}
+}
+
+func TestRunRefresh(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "from a1\n"})
+	client.SetOutput("b1", dlatest.Output{Stdout: "from b1\n"})
+
+	var out, info syncBuffer
+	agg := dla.New(client, &out, dla.Options{Follow: true, Refresh: 10 * time.Millisecond, Info: &info, Format: dla.FormatJSON})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- agg.Run(ctx) }()
+
+	waitFor(t, "the listed container", func() bool {
+		return strings.Contains(out.String(), "from a1")
+	})
+
+	client.AddContainer(container("b1", "worker"))
+	waitFor(t, "the newly listed container", func() bool {
+		return strings.Contains(out.String(), "from b1")
+	})
+
+	client.RemoveContainer("a1")
+	waitFor(t, "the vanished container's stream to stop", func() bool {
+		return strings.Contains(info.String(), "Stream web exited")
+	})
+	// further refreshes keep b1's one stream
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	streamed := map[string]int{}
+	for _, line := range decodeLines(t, out.String()) {
+		streamed[line.Container]++
+	}
+	if streamed["a1"] != 1 || streamed["b1"] != 1 {
+		t.Errorf("lines per container = %v, want one each", streamed)
+	}
+}
+
+func TestExitGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		follow   bool
+		grace    time.Duration
+		wantLate bool
+	}{
+		{name: "one-shot drains to the end", wantLate: true},
+		{name: "cut off without a grace", follow: true},
+		{name: "written within the grace", follow: true, grace: time.Second, wantLate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{
+				Stdout:    "first\n",
+				Late:      "late one\nlate two\n",
+				LateAfter: 100 * time.Millisecond,
+			})
+
+			var out syncBuffer
+			agg := dla.New(client, &out, dla.Options{Follow: tt.follow, ExitGrace: tt.grace})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(ctx) }()
+
+			if tt.follow {
+				waitFor(t, "the first line", func() bool {
+					return strings.Contains(out.String(), "first")
+				})
+				cancel()
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			got := out.String()
+			for _, late := range []string{"late one", "late two"} {
+				if strings.Contains(got, late) != tt.wantLate {
+					t.Errorf("output has %q = %v, want %v:\n%s", late, !tt.wantLate, tt.wantLate, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEOFGrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		flushed string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "one-shot stops at the end of the logs",
+			flushed: "2020-01-01T00:00:02.000000000Z burst one\n",
+			want:    []string{"first"},
+			notWant: []string{"burst one"},
+		},
+		{
+			name:    "burst flushed within the grace",
+			grace:   100 * time.Millisecond,
+			flushed: "2020-01-01T00:00:02.000000000Z burst one\n2020-01-01T00:00:02.500000000Z burst two\n",
+			want:    []string{"first", "burst one", "burst two"},
+			notWant: []string{"2020-01-01"},
+		},
+		{
+			name:    "lines logged after the read began end it",
+			grace:   time.Minute,
+			flushed: "2020-01-01T00:00:02.000000000Z burst one\n2999-01-01T00:00:00.000000000Z later\n",
+			want:    []string{"first", "burst one"},
+			notWant: []string{"later"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{
+				Stdout:  "2020-01-01T00:00:01.000000000Z first\n",
+				Flushed: tt.flushed,
+			})
+
+			var out syncBuffer
+			agg := dla.New(client, &out, dla.Options{EOFGrace: tt.grace})
+
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(context.Background()) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return once the grace was over")
+			}
+
+			got := out.String()
+			for _, s := range tt.want {
+				if !strings.Contains(got, s) {
+					t.Errorf("output is missing %q:\n%s", s, got)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(got, s) {
+					t.Errorf("output has %q:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFinalLine(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "one\nlast out", Stderr: "last err"})
+
+	var out syncBuffer
+	agg := dla.New(client, &out, dla.Options{Format: dla.FormatJSON})
+	if err := agg.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, line := range decodeLines(t, out.String()) {
+		got[line.Message] = line.Stream
+	}
+	want := map[string]string{"one": "stdout", "last out": "stdout", "last err": "stderr"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+}
+
+func TestFollowBackfill(t *testing.T) {
+	tests := []struct {
+		name  string
+		tail  string
+		since int64
+	}{
+		{name: "tail", tail: "100"},
+		{name: "since", since: 1577836800},
+		{name: "tail and since", tail: "5", since: 1577836800},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(container("a1", "web"))
+			client.SetOutput("a1", dlatest.Output{
+				Stdout:    "history\n",
+				Late:      "live\n",
+				LateAfter: 20 * time.Millisecond,
+			})
+
+			var out syncBuffer
+			agg := dla.New(client, &out, dla.Options{Follow: true, Tail: tt.tail, Since: tt.since, Format: dla.FormatJSON})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- agg.Run(ctx) }()
+
+			waitFor(t, "the live line", func() bool {
+				return strings.Contains(out.String(), "live")
+			})
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if len(client.LogsCalls) != 1 {
+				t.Fatalf("got %d Logs calls, want 1", len(client.LogsCalls))
+			}
+			if call := client.LogsCalls[0]; !call.Follow || call.Tail != tt.tail || call.Since != tt.since {
+				t.Errorf("Logs call = Follow %v Tail %q Since %d, want Follow true Tail %q Since %d", call.Follow, call.Tail, call.Since, tt.tail, tt.since)
+			}
+
+			var got []string
+			for _, line := range decodeLines(t, out.String()) {
+				got = append(got, line.Message)
+			}
+			if want := []string{"history", "live"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("lines = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunWriteErrors(t *testing.T) {
+	client := dlatest.NewClient(container("a1", "web"))
+	client.SetOutput("a1", dlatest.Output{Stdout: "one\n"})
+
+	var errs syncBuffer
+	agg := dla.New(client, failWriter{}, dla.Options{Errors: &errs})
+	agg.Run(context.Background())
+
+	if got := errs.String(); !strings.Contains(got, "Error attempting to write to dest: output closed") {
+		t.Errorf("errors = %q, want the failed write reported", got)
+	}
+}
+
+// failWriter fails every Write.
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("output closed")
+}
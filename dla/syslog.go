@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package dla
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// dialSyslog connects to the syslog daemon at addr, the local one when
+// empty, logging as tag. addr may name its network as in udp://host:514,
+// defaulting to udp. Lines written to out are logged at info severity and
+// those written to errOut at err.
+func dialSyslog(addr, tag string) (out, errOut io.Writer, closeFn func() error, err error) {
+	var network string
+	if addr != "" {
+		network = "udp"
+		if i := strings.Index(addr, "://"); i >= 0 {
+			network, addr = addr[:i], addr[i+3:]
+		}
+	}
+
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &syslogWriter{w: w}, &syslogWriter{w: w, err: true}, w.Close, nil
+}
+
+// syslogWriter logs every write as one message at info severity, or err.
+type syslogWriter struct {
+	w   *syslog.Writer
+	err bool
+}
+
+func (sw *syslogWriter) Write(b []byte) (int, error) {
+	log := sw.w.Info
+	if sw.err {
+		log = sw.w.Err
+	}
+	if err := log(string(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
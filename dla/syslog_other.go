@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package dla
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(addr, tag string) (out, errOut io.Writer, closeFn func() error, err error) {
+	return nil, nil, nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,73 @@
+//go:build !windows && !plan9
+
+package dla
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialSyslog(t *testing.T) {
+	tests := []struct {
+		network string
+		serve   func(t *testing.T, got chan<- string) string
+	}{
+		{network: "udp", serve: func(t *testing.T, got chan<- string) string {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					n, _, err := conn.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					got <- string(buf[:n])
+				}
+			}()
+			return conn.LocalAddr().String()
+		}},
+		{network: "tcp", serve: func(t *testing.T, got chan<- string) string {
+			return listen(t, func(conn net.Conn) {
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					got <- sc.Text()
+				}
+			})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			got := make(chan string, 2)
+			addr := tt.serve(t, got)
+
+			out, errOut, closeFn, err := dialSyslog(tt.network+"://"+addr, "web.1")
+			if err != nil {
+				t.Fatalf("dialSyslog() error = %v", err)
+			}
+			defer closeFn()
+			out.Write([]byte("served /\n"))
+			errOut.Write([]byte("failed /\n"))
+
+			// daemon facility, at info for stdout and err for stderr
+			for _, want := range []struct{ pri, msg string }{{"<30>", "served /"}, {"<27>", "failed /"}} {
+				select {
+				case line := <-got:
+					line = strings.TrimSuffix(line, "\n")
+					if !strings.HasPrefix(line, want.pri) || !strings.Contains(line, " web.1[") || !strings.HasSuffix(line, ": "+want.msg) {
+						t.Errorf("syslog got %q, want %s from web.1 with %q", line, want.pri, want.msg)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for %q", want.msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package dla
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const shortIDLength = 12
+
+// getTag names a container for display, using the value of label when set
+// and present, then its swarm task name, then its compose
+// project_service_index and otherwise its container name or short ID.
+func getTag(cont docker.APIContainers, label string) string {
+	if tag := cont.Labels[label]; label != "" && tag != "" {
+		return tag
+	}
+	if tag := cont.Labels[swarmTaskNameKey]; tag != "" {
+		return tag
+	}
+
+	project, service := cont.Labels[composeProjectKey], cont.Labels[composeServiceKey]
+	if project != "" && service != "" {
+		tag := project + "_" + service
+		if n := cont.Labels[composeNumberKey]; n != "" {
+			tag += "_" + n
+		}
+		return tag
+	}
+
+	for _, name := range cont.Names {
+		if name = strings.TrimPrefix(name, "/"); name != "" {
+			return name
+		}
+	}
+
+	return shortID(cont.ID)
+}
+
+// serviceName is the swarm or, failing that, compose service cont belongs to.
+func serviceName(cont docker.APIContainers) string {
+	if name := cont.Labels[swarmServiceNameKey]; name != "" {
+		return name
+	}
+	return cont.Labels[composeServiceKey]
+}
+
+func shortID(id string) string {
+	if len(id) > shortIDLength {
+		return id[:shortIDLength]
+	}
+	return id
+}
+
+// tagFields selects what is printed in a tag after the container's name.
+type tagFields struct {
+	// id is the short container ID, telling apart containers sharing a name.
+	id bool
+	// node is the short ID of the swarm node the task runs on, when known.
+	node bool
+	// label is the container label naming it, when it carries one.
+	label string
+}
+
+// displayTag is the tag printed for cont.
+func displayTag(cont docker.APIContainers, fields tagFields) string {
+	tag := getTag(cont, fields.label)
+	if fields.id {
+		tag += " " + shortID(cont.ID)
+	}
+	if node := cont.Labels[swarmNodeIDKey]; fields.node && node != "" {
+		tag += " @" + shortID(node)
+	}
+	return tag
+}
+
+func getTags(conts []docker.APIContainers, fields tagFields) []tagEntry {
+	tags := make([]tagEntry, 0, len(conts))
+	for _, cont := range conts {
+		tags = append(tags, tagEntry{id: cont.ID, tag: displayTag(cont, fields)})
+	}
+	return tags
+}
+
+var colors = []*color.Color{
+	color.New(color.FgHiRed),
+	color.New(color.FgHiGreen),
+	color.New(color.FgHiYellow),
+	color.New(color.FgHiBlue),
+	color.New(color.FgHiMagenta),
+	color.New(color.FgHiCyan),
+	color.New(color.FgRed),
+	color.New(color.FgGreen),
+	color.New(color.FgYellow),
+	color.New(color.FgBlue),
+	color.New(color.FgMagenta),
+	color.New(color.FgCyan),
+}
+
+var namedColors = map[string]color.Attribute{
+	"black":      color.FgBlack,
+	"red":        color.FgRed,
+	"green":      color.FgGreen,
+	"yellow":     color.FgYellow,
+	"blue":       color.FgBlue,
+	"magenta":    color.FgMagenta,
+	"cyan":       color.FgCyan,
+	"white":      color.FgWhite,
+	"hi-black":   color.FgHiBlack,
+	"hi-red":     color.FgHiRed,
+	"hi-green":   color.FgHiGreen,
+	"hi-yellow":  color.FgHiYellow,
+	"hi-blue":    color.FgHiBlue,
+	"hi-magenta": color.FgHiMagenta,
+	"hi-cyan":    color.FgHiCyan,
+	"hi-white":   color.FgHiWhite,
+}
+
+var namedAttributes = map[string]color.Attribute{
+	"bold":      color.Bold,
+	"faint":     color.Faint,
+	"italic":    color.Italic,
+	"underline": color.Underline,
+	"reverse":   color.ReverseVideo,
+}
+
+// ParseColor parses a color name such as red or hi-blue, or a 256 color
+// palette code from 0 to 255.
+func ParseColor(name string) (*color.Color, error) {
+	attrs, err := colorAttributes(name)
+	if err != nil {
+		return nil, err
+	}
+	return color.New(attrs...), nil
+}
+
+// ParseStyle parses attributes such as bold or underline, optionally with a
+// color as ParseColor takes it, joined by + as in bold+yellow.
+func ParseStyle(spec string) (*color.Color, error) {
+	var attrs []color.Attribute
+	for _, name := range strings.Split(spec, "+") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if attr, ok := namedAttributes[name]; ok {
+			attrs = append(attrs, attr)
+			continue
+		}
+
+		c, err := colorAttributes(name)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, c...)
+	}
+	return color.New(attrs...), nil
+}
+
+// colorAttributes is the escape code attributes of the color name, see
+// ParseColor.
+func colorAttributes(name string) ([]color.Attribute, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if attr, ok := namedColors[name]; ok {
+		return []color.Attribute{attr}, nil
+	}
+
+	if code, err := strconv.Atoi(name); err == nil {
+		if code < 0 || code > 255 {
+			return nil, fmt.Errorf("color code %d out of range 0-255", code)
+		}
+		// 38;5;n selects from the 256 color palette
+		return []color.Attribute{38, 5, color.Attribute(code)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown color %q", name)
+}
+
+// ParsePalette parses a comma separated list of colors, see ParseColor.
+func ParsePalette(list string) ([]*color.Color, error) {
+	names := strings.Split(list, ",")
+	palette := make([]*color.Color, 0, len(names))
+	for _, name := range names {
+		c, err := ParseColor(name)
+		if err != nil {
+			return nil, err
+		}
+		palette = append(palette, c)
+	}
+	return palette, nil
+}
+
+// streamColors color the tags of each stream under ColorByStream.
+var streamColors = struct {
+	stdout *color.Color
+	stderr *color.Color
+}{
+	stdout: color.New(color.FgHiCyan),
+	stderr: color.New(color.FgHiRed),
+}
+
+// colorPicker chooses the color of the i'th distinct tag, a nil picker
+// leaves tags plain.
+type colorPicker func(i int, tag string) *color.Color
+
+// indexColors cycles through palette in sorted tag order.
+func indexColors(palette []*color.Color) colorPicker {
+	return func(i int, _ string) *color.Color {
+		return palette[i%len(palette)]
+	}
+}
+
+// hashColors picks from palette by hashing the tag so a tag keeps its color
+// whichever other tags are present.
+func hashColors(palette []*color.Color) colorPicker {
+	return func(_ int, tag string) *color.Color {
+		h := fnv.New32a()
+		h.Write([]byte(tag))
+		return palette[h.Sum32()%uint32(len(palette))]
+	}
+}
+
+// fixedColor colors every tag with c.
+func fixedColor(c *color.Color) colorPicker {
+	return func(int, string) *color.Color {
+		return c
+	}
+}
+
+func (pick colorPicker) paint(i int, tag, s string) string {
+	if pick == nil {
+		return s
+	}
+	return pick(i, tag).Sprint(s)
+}
+
+// tagStyle is how tagConfig lays tags out.
+type tagStyle struct {
+	// sep follows every padded tag.
+	sep string
+	// alignRight pads tags on the left rather than the right.
+	alignRight bool
+	// max cuts longer tags short with an ellipsis, zero for no limit.
+	max int
+	// after renders tags to follow messages, led by the separator and not
+	// padded.
+	after bool
+}
+
+// fit cuts tag to style.max characters, its last an ellipsis.
+func (style tagStyle) fit(tag string) string {
+	if style.max <= 0 || utf8.RuneCountInString(tag) <= style.max {
+		return tag
+	}
+	runes := []rune(tag)
+	return string(runes[:style.max-1]) + "…"
+}
+
+// render fits and pads tag to width, painted by pick as the i'th tag under
+// key, and follows it with the separator. Colored tags get a dim separator so
+// the name stands out from it.
+func (style tagStyle) render(pick colorPicker, i int, key, tag string, width int) []byte {
+	sep := style.sep
+	if pick != nil && sep != "" {
+		sep = dim.Sprint(sep)
+	}
+	if style.after {
+		return []byte(sep + pick.paint(i, key, style.fit(tag)))
+	}
+	return []byte(pick.paint(i, key, style.pad(style.fit(tag), width)) + sep)
+}
+
+// pad widens tag to width with spaces on the side style calls for.
+func (style tagStyle) pad(tag string, width int) string {
+	n := width - utf8.RuneCountInString(tag)
+	if n <= 0 {
+		return tag
+	}
+	if style.alignRight {
+		return strings.Repeat(" ", n) + tag
+	}
+	return tag + strings.Repeat(" ", n)
+}
+
+// tagEntry is the tag shown for the container with id.
+type tagEntry struct {
+	id  string
+	tag string
+}
+
+// maxTagVariants bounds the tries to find a color unused by a tag's other
+// containers.
+const maxTagVariants = 64
+
+// tagConfig returns a lookup of each container's padded, colored tag, by
+// container ID. Containers sharing a tag are told apart by color. It is meant
+// to be consulted once per stream rather than per line, see
+// streamer.tagsFor.
+func tagConfig(entries []tagEntry, style tagStyle, pick colorPicker) func(id, tag string) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	var tagLength int
+	for _, e := range entries {
+		if l := utf8.RuneCountInString(style.fit(e.tag)); l > tagLength {
+			tagLength = l
+		}
+	}
+
+	cm := map[string][]byte{}
+	first := map[string][]byte{}
+	used := map[string][]*color.Color{}
+	add := func(id, tag string) []byte {
+		i := len(cm)
+		// a tag already taken by another container is colored under a variant
+		// of it until the color differs
+		key := tag
+		if pick != nil {
+			for k := 1; k < maxTagVariants && hasColor(used[tag], pick(i, key)); k++ {
+				key = tag + "#" + strconv.Itoa(k)
+			}
+			used[tag] = append(used[tag], pick(i, key))
+		}
+
+		fmtTag := style.render(pick, i, key, tag, tagLength)
+		cm[id] = fmtTag
+		if _, ok := first[tag]; !ok {
+			first[tag] = fmtTag
+		}
+		return fmtTag
+	}
+
+	for _, e := range entries {
+		if _, ok := cm[e.id]; !ok {
+			add(e.id, e.tag)
+		}
+	}
+
+	var mu sync.Mutex
+	return func(id, tag string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if fmtTag, ok := cm[id]; ok {
+			return fmtTag
+		}
+		// containers first seen after setup, such as replaced tasks or those
+		// started while watching, keep the color already shown under their
+		// tag or take the next one, padding to at least the same width
+		if fmtTag, ok := first[tag]; ok {
+			cm[id] = fmtTag
+			return fmtTag
+		}
+		return add(id, tag)
+	}
+}
+
+func hasColor(colors []*color.Color, c *color.Color) bool {
+	for _, used := range colors {
+		if used == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,350 @@
+package dla_test
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fatih/color"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// withColor sets color.NoColor for the rest of the test, tests otherwise
+// running without color as their output is no terminal.
+func withColor(t *testing.T, on bool) {
+	t.Helper()
+	noColor := color.NoColor
+	color.NoColor = !on
+	t.Cleanup(func() { color.NoColor = noColor })
+}
+
+// prefixes runs an Aggregator over conts, each writing "out <name>" to
+// stdout and "err <name>" to stderr, and returns what came before each
+// message by the message.
+func prefixes(t *testing.T, opts dla.Options, conts ...docker.APIContainers) map[string]string {
+	t.Helper()
+
+	client := dlatest.NewClient(conts...)
+	for _, cont := range conts {
+		name := strings.TrimPrefix(cont.Names[0], "/")
+		client.SetOutput(cont.ID, dlatest.Output{Stdout: "out " + name + "\n", Stderr: "err " + name + "\n"})
+	}
+
+	var out syncBuffer
+	if err := dla.New(client, &out, opts).Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		i := strings.Index(line, "out ")
+		if i < 0 {
+			i = strings.Index(line, "err ")
+		}
+		if i < 0 {
+			t.Fatalf("Run() wrote %q, want a message in it", line)
+		}
+		got[trailingEscape.ReplaceAllString(line[i:], "")] = line[:i]
+	}
+	return got
+}
+
+// leadingEscape matches the escape code a colored tag opens with and
+// trailingEscape the one a colored message closes with.
+var (
+	leadingEscape  = regexp.MustCompile(`^\x1b\[[0-9;]*m`)
+	trailingEscape = regexp.MustCompile(`\x1b\[[0-9;]*m$`)
+)
+
+// tagColor is the escape code prefix opens with, empty for a plain tag.
+func tagColor(prefix string) string {
+	return leadingEscape.FindString(prefix)
+}
+
+func TestNoColor(t *testing.T) {
+	withColor(t, false)
+
+	got := prefixes(t, dla.Options{Separator: " | "}, container("a1", "web"), container("b1", "cache"))
+	want := map[string]string{
+		"out web":   "web   | ",
+		"err web":   "web   | ",
+		"out cache": "cache | ",
+		"err cache": "cache | ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prefixes = %q, want %q", got, want)
+	}
+}
+
+func TestColorByStream(t *testing.T) {
+	withColor(t, true)
+
+	got := prefixes(t, dla.Options{ColorBy: dla.ColorByStream}, container("a1", "web"), container("b1", "api"), container("c1", "db"))
+	stdout, stderr := tagColor(got["out web"]), tagColor(got["err web"])
+	if stdout == "" || stderr == "" || stdout == stderr {
+		t.Fatalf("web tags colored %q on stdout and %q on stderr, want two colors", stdout, stderr)
+	}
+	for _, name := range []string{"api", "db"} {
+		if c := tagColor(got["out "+name]); c != stdout {
+			t.Errorf("%s stdout tag colored %q, want %q like web", name, c, stdout)
+		}
+		if c := tagColor(got["err "+name]); c != stderr {
+			t.Errorf("%s stderr tag colored %q, want %q like web", name, c, stderr)
+		}
+	}
+}
+
+func TestColorByContainer(t *testing.T) {
+	withColor(t, true)
+
+	few := []docker.APIContainers{container("a1", "web"), container("b1", "api")}
+	many := []docker.APIContainers{container("a1", "web"), container("c1", "db"), container("d1", "cache"), container("e1", "queue")}
+
+	before, after := tagColor(prefixes(t, dla.Options{}, few...)["out web"]), tagColor(prefixes(t, dla.Options{}, many...)["out web"])
+	if before == "" || before != after {
+		t.Errorf("web tag colored %q beside api and %q beside db, cache and queue, want one color", before, after)
+	}
+
+	// -color-by index keeps the old shifting colors, web coming second
+	// among two tags and last among four
+	opts := dla.Options{ColorBy: dla.ColorByIndex}
+	before, after = tagColor(prefixes(t, opts, few...)["out web"]), tagColor(prefixes(t, opts, many...)["out web"])
+	if before == after {
+		t.Errorf("web tag colored %q by index among both sets, want its color to follow its place", before)
+	}
+}
+
+func TestPalette(t *testing.T) {
+	withColor(t, true)
+
+	palette, err := dla.ParsePalette("red, 208")
+	if err != nil {
+		t.Fatalf("ParsePalette() error = %v", err)
+	}
+	got := prefixes(t, dla.Options{ColorBy: dla.ColorByIndex, Palette: palette}, container("a1", "a"), container("b1", "b"), container("c1", "c"))
+	for tag, want := range map[string]string{"a": "\x1b[31m", "b": "\x1b[38;5;208m", "c": "\x1b[31m"} {
+		if c := tagColor(got["out "+tag]); c != want {
+			t.Errorf("tag %s colored %q, want %q", tag, c, want)
+		}
+	}
+}
+
+func TestParsePalette(t *testing.T) {
+	tests := []struct {
+		list    string
+		wantErr string
+	}{
+		{list: "red,hi-blue,0,255"},
+		{list: "red,nope", wantErr: `unknown color "nope"`},
+		{list: "red,256", wantErr: "color code 256 out of range 0-255"},
+		{list: "red,,blue", wantErr: `unknown color ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			_, err := dla.ParsePalette(tt.list)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("ParsePalette() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("ParsePalette() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNoticeColor(t *testing.T) {
+	withColor(t, true)
+
+	var info syncBuffer
+	got := prefixes(t, dla.Options{Info: &info}, container("a1", "web"), container("b1", "api"))
+	notices := strings.Split(strings.TrimSuffix(info.String(), "\n"), "\n")
+	if len(notices) != 2 {
+		t.Fatalf("Info got %q, want an exit notice per container", notices)
+	}
+	for _, name := range []string{"web", "api"} {
+		want := tagColor(got["out "+name])
+		for _, notice := range notices {
+			if !strings.Contains(notice, name) {
+				continue
+			}
+			if !strings.Contains(notice, "■ ") || !strings.Contains(notice, "stream exited") {
+				t.Errorf("Info got %q, want an exit notice", notice)
+			}
+			if c := tagColor(notice); c == "" || c != want {
+				t.Errorf("%s exit notice colored %q, want %q like its log lines", name, c, want)
+			}
+		}
+	}
+}
+
+func TestStderrColor(t *testing.T) {
+	withColor(t, true)
+
+	style, err := dla.ParseStyle("bold+yellow")
+	if err != nil {
+		t.Fatalf("ParseStyle() error = %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		opts dla.Options
+		want string
+	}{
+		{name: "default", want: "\x1b[91m"},
+		{name: "configured", opts: dla.Options{StderrColor: style}, want: "\x1b[1;33m"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := prefixes(t, tt.opts, container("a1", "web"))
+			if prefix := got["err web"]; !strings.HasSuffix(prefix, tt.want) {
+				t.Errorf("stderr line prefixed %q, want it to end in %q", prefix, tt.want)
+			}
+			if prefix := got["out web"]; strings.HasSuffix(prefix, tt.want) {
+				t.Errorf("stdout line prefixed %q, want it left uncolored", prefix)
+			}
+		})
+	}
+}
+
+func TestParseStyle(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{spec: "yellow"},
+		{spec: "bold+yellow"},
+		{spec: "Underline + 208"},
+		{spec: "bold+blink", wantErr: `unknown color "blink"`},
+		{spec: "bold+-1", wantErr: "color code -1 out of range 0-255"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := dla.ParseStyle(tt.spec)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("ParseStyle() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("ParseStyle() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTagLayout(t *testing.T) {
+	withColor(t, false)
+
+	web := container("aaaaaaaaaaaaaaaaaaaa", "web")
+	cache := container("bbbbbbbbbbbbbbbbbbbb", "cache")
+	task := container("cccccccccccccccccccc", "web.1.x7")
+	task.Labels = map[string]string{"com.docker.swarm.node.id": "nodenodenode1234"}
+
+	tests := []struct {
+		name  string
+		opts  dla.Options
+		conts []docker.APIContainers
+		want  map[string]string
+	}{
+		{
+			name:  "show id",
+			opts:  dla.Options{ShowID: true},
+			conts: []docker.APIContainers{web, cache},
+			want: map[string]string{
+				"web":   "web aaaaaaaaaaaa   | ",
+				"cache": "cache bbbbbbbbbbbb | ",
+			},
+		},
+		{
+			name:  "show node",
+			opts:  dla.Options{ShowNode: true},
+			conts: []docker.APIContainers{task, cache},
+			want: map[string]string{
+				"web.1.x7": "web.1.x7 @nodenodenode | ",
+				"cache":    "cache                  | ",
+			},
+		},
+		{
+			name:  "align left",
+			conts: []docker.APIContainers{container("a1", "web.1"), container("a10", "web.10")},
+			want: map[string]string{
+				"web.1":  "web.1  | ",
+				"web.10": "web.10 | ",
+			},
+		},
+		{
+			name:  "align right",
+			opts:  dla.Options{Align: dla.AlignRight},
+			conts: []docker.APIContainers{container("a1", "web.1"), container("a10", "web.10")},
+			want: map[string]string{
+				"web.1":  " web.1 | ",
+				"web.10": "web.10 | ",
+			},
+		},
+		{
+			name:  "max tag",
+			opts:  dla.Options{MaxTag: 8},
+			conts: []docker.APIContainers{container("a1", "a-very-long-service"), container("b1", "db")},
+			want: map[string]string{
+				"a-very-long-service": "a-very-… | ",
+				"db":                  "db       | ",
+			},
+		},
+		{
+			name:  "max tag past the longest",
+			opts:  dla.Options{MaxTag: 20},
+			conts: []docker.APIContainers{container("a1", "web"), container("b1", "db")},
+			want: map[string]string{
+				"web": "web | ",
+				"db":  "db  | ",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Separator = " | "
+			got := prefixes(t, tt.opts, tt.conts...)
+			for name, want := range tt.want {
+				for _, msg := range []string{"out " + name, "err " + name} {
+					if got[msg] != want {
+						t.Errorf("%q prefixed %q, want %q", msg, got[msg], want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	filter := &dla.LineFilter{Include: regexp.MustCompile("web")}
+	tests := []struct {
+		name   string
+		color  bool
+		format dla.Format
+		want   bool
+	}{
+		{name: "text", color: true, format: dla.FormatText, want: true},
+		{name: "no color", format: dla.FormatText},
+		{name: "json", color: true, format: dla.FormatJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withColor(t, tt.color)
+
+			client := dlatest.NewClient(container("a1", "api"))
+			client.SetOutput("a1", dlatest.Output{Stdout: "GET web\n"})
+
+			var out syncBuffer
+			if err := dla.New(client, &out, dla.Options{Format: tt.format, Filter: filter}).Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := strings.Contains(out.String(), "\x1b[1;4mweb"); got != tt.want {
+				t.Errorf("Run() wrote %q, highlighted %v, want %v", out.String(), got, tt.want)
+			}
+		})
+	}
+}
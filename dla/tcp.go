@@ -0,0 +1,142 @@
+package dla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrWriterClosed is returned by writes to a closed TCPWriter.
+var ErrWriterClosed = errors.New("writer closed")
+
+// TCPWriter writes to a log collector over TCP. The connection is made on
+// the first write and redialled with exponential backoff whenever it drops,
+// writes blocking meanwhile and the interrupted write being retried in full.
+// Close cuts short a dial or write blocked on a collector that stopped
+// answering.
+type TCPWriter struct {
+	addr    string
+	notices io.Writer
+
+	// mu is held by Write throughout, serialising writes.
+	mu sync.Mutex
+	// connMu guards conn alone, so Close reaches it while a write is blocked.
+	connMu sync.Mutex
+	conn   net.Conn
+	// closed is cancelled by Close, ending any dial in progress.
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+// NewTCPWriter creates a TCPWriter for addr, reporting lost connections to
+// notices when it is not nil.
+func NewTCPWriter(addr string, notices io.Writer) *TCPWriter {
+	if notices == nil {
+		notices = io.Discard
+	}
+
+	closed, cancel := context.WithCancel(context.Background())
+	return &TCPWriter{
+		addr:    addr,
+		notices: notices,
+		closed:  closed,
+		cancel:  cancel,
+	}
+}
+
+func (tw *TCPWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	delay := reconnectBaseDelay
+	for {
+		if tw.closed.Err() != nil {
+			return 0, ErrWriterClosed
+		}
+
+		conn, err := tw.dial()
+		if err == nil {
+			var n int
+			if n, err = fullWrite(conn, b); err == nil {
+				return n, nil
+			}
+			tw.drop(conn)
+			if tw.closed.Err() != nil {
+				return n, ErrWriterClosed
+			}
+		} else if tw.closed.Err() != nil {
+			return 0, ErrWriterClosed
+		}
+
+		fmt.Fprintf(tw.notices, "Connection to %s lost, reconnecting in %s: %s\n", tw.addr, delay, err)
+		select {
+		case <-tw.closed.Done():
+			return 0, ErrWriterClosed
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// dial returns the connection, connecting unless already connected. tw.mu
+// must be held.
+func (tw *TCPWriter) dial() (net.Conn, error) {
+	tw.connMu.Lock()
+	conn := tw.conn
+	tw.connMu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	d := net.Dialer{Timeout: reconnectMaxDelay}
+	conn, err := d.DialContext(tw.closed, "tcp", tw.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tw.connMu.Lock()
+	defer tw.connMu.Unlock()
+
+	// Close may have come between the dial and here
+	if tw.closed.Err() != nil {
+		conn.Close()
+		return nil, ErrWriterClosed
+	}
+	tw.conn = conn
+	return conn, nil
+}
+
+// drop closes conn after a failed write unless Close already has.
+func (tw *TCPWriter) drop(conn net.Conn) {
+	tw.connMu.Lock()
+	defer tw.connMu.Unlock()
+
+	if tw.conn == conn {
+		conn.Close()
+		tw.conn = nil
+	}
+}
+
+// Close stops any reconnecting and closes the connection, failing a write
+// blocked on it without waiting for the write to return.
+func (tw *TCPWriter) Close() error {
+	tw.cancel()
+
+	tw.connMu.Lock()
+	defer tw.connMu.Unlock()
+
+	if tw.conn == nil {
+		return nil
+	}
+	// a deadline already passed fails the blocked write at once
+	tw.conn.SetWriteDeadline(time.Unix(1, 0))
+	err := tw.conn.Close()
+	tw.conn = nil
+	return err
+}
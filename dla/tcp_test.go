@@ -0,0 +1,106 @@
+package dla
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen accepts connections on a loopback port, passing each to serve.
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTCPWriter(t *testing.T) {
+	lines := make(chan string, 2)
+	addr := listen(t, func(conn net.Conn) {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	})
+
+	tw := NewTCPWriter(addr, nil)
+	for _, line := range []string{"one", "two"} {
+		if _, err := tw.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-lines; got != line {
+			t.Errorf("received %q, want %q", got, line)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("late\n")); err != ErrWriterClosed {
+		t.Errorf("Write after Close = %v, want ErrWriterClosed", err)
+	}
+}
+
+func TestTCPWriterCloseHung(t *testing.T) {
+	// a collector that accepts and never reads
+	addr := listen(t, func(conn net.Conn) {})
+
+	tw := NewTCPWriter(addr, nil)
+	written := make(chan error, 1)
+	go func() {
+		// far more than the socket buffers hold
+		_, err := tw.Write(make([]byte, 64<<20))
+		written <- err
+	}()
+
+	// wait for the write to block on the full connection
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned %v before Close", err)
+	default:
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- tw.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited on the blocked write")
+	}
+	select {
+	case err := <-written:
+		if err != ErrWriterClosed {
+			t.Errorf("blocked Write = %v, want ErrWriterClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked Write not cut short by Close")
+	}
+}
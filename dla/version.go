@@ -0,0 +1,36 @@
+package dla
+
+import (
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// apiSince is the first docker API version whose logs endpoint takes since.
+var apiSince = docker.APIVersion{1, 19}
+
+// apiDetails is the first docker API version whose logs endpoint takes
+// details.
+var apiDetails = docker.APIVersion{1, 25}
+
+// supports reports whether the daemon speaks at least min, assuming it does
+// when the version is unknown.
+func (a *Aggregator) supports(min docker.APIVersion) bool {
+	return len(a.opts.APIVersion) == 0 || a.opts.APIVersion.GreaterThanOrEqualTo(min)
+}
+
+// checkVersion reports options the daemon is too old to honor.
+func (a *Aggregator) checkVersion() error {
+	if a.opts.Since != 0 && !a.supports(apiSince) {
+		return fmt.Errorf("since needs docker API %s or newer, the daemon speaks %s", apiSince, a.opts.APIVersion)
+	}
+	if a.opts.Details && !a.details() {
+		fmt.Fprintf(a.opts.Errors, "Details need docker API %s or newer, the daemon speaks %s, streaming without them\n", apiDetails, a.opts.APIVersion)
+	}
+	return nil
+}
+
+// details reports whether details are both requested and supported.
+func (a *Aggregator) details() bool {
+	return a.opts.Details && a.supports(apiDetails)
+}
@@ -0,0 +1,66 @@
+package dla_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Morgahl/dockerutils/dla"
+	"github.com/Morgahl/dockerutils/dla/dlatest"
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestAPIVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     docker.APIVersion
+		opts        dla.Options
+		wantErr     string
+		wantWarning string
+		wantSince   int64
+		wantService bool
+	}{
+		{name: "since, version unknown", opts: dla.Options{Since: 1577836800}, wantSince: 1577836800},
+		{name: "since", version: docker.APIVersion{1, 19}, opts: dla.Options{Since: 1577836800}, wantSince: 1577836800},
+		{name: "since too old", version: docker.APIVersion{1, 18}, opts: dla.Options{Since: 1577836800}, wantErr: "since needs docker API 1.19 or newer, the daemon speaks 1.18"},
+		{name: "service logs", version: docker.APIVersion{1, 29}, opts: dla.Options{ServiceLogs: true}, wantService: true},
+		{name: "service logs too old", version: docker.APIVersion{1, 28}, opts: dla.Options{ServiceLogs: true}, wantWarning: "Service logs are not available"},
+		{name: "details too old", version: docker.APIVersion{1, 24}, opts: dla.Options{ServiceLogs: true, Details: true}, wantWarning: "Details need docker API 1.25 or newer, the daemon speaks 1.24"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dlatest.NewClient(task("t1", "web", "1"))
+			client.SetOutput("t1", dlatest.Output{Stdout: "hello\n"})
+
+			var out, errs syncBuffer
+			opts := tt.opts
+			opts.APIVersion, opts.Errors = tt.version, &errs
+			err := dla.New(client, &out, opts).Run(context.Background())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Run() error = %v", err)
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Run() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if len(client.LogsCalls) != 0 {
+					t.Errorf("got %d Logs calls, want none", len(client.LogsCalls))
+				}
+				return
+			}
+
+			if tt.wantWarning != "" && !strings.Contains(errs.String(), tt.wantWarning) {
+				t.Errorf("errors = %q, want them to contain %q", errs.String(), tt.wantWarning)
+			}
+			// a daemon too old for the service logs endpoint is not sent
+			// to it
+			if got := len(client.ServiceLogsCalls) == 1; got != tt.wantService {
+				t.Fatalf("ServiceLogsCalls = %+v, want service logs %v", client.ServiceLogsCalls, tt.wantService)
+			}
+			if !tt.wantService && (len(client.LogsCalls) != 1 || client.LogsCalls[0].Since != tt.wantSince) {
+				t.Errorf("LogsCalls = %+v, want one since %d", client.LogsCalls, tt.wantSince)
+			}
+		})
+	}
+}
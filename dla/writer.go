@@ -0,0 +1,1127 @@
+package dla
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/fatih/color"
+)
+
+const dockerTimeLayout = time.RFC3339Nano
+
+type lineConfig struct {
+	timestamps bool
+	timeLoc    *time.Location
+	timeLayout string
+	filter     *LineFilter
+	maxLine    int
+	keepCR     bool
+	split      bufio.SplitFunc
+	counter    *atomic.Uint64
+	tmpl       *template.Template
+	info       StreamInfo
+	merge      *Merger
+	stripANSI  bool
+	rate       float64
+	dedupe     bool
+	multiline  *regexp.Regexp
+	highlight  *regexp.Regexp
+	details    bool
+	limits     []*lineLimit
+	tagAfter   bool
+	seq        *sequence
+	seqAfter   bool
+	until      time.Time
+	pastUntil  func()
+	errors     io.Writer
+}
+
+// LineOption configures optional LineWriter behaviour.
+type LineOption func(*lineConfig)
+
+// WithTimestamps makes LineWriter parse the timestamp docker prepends to each
+// line when LogsOptions.Timestamps is set and render it in loc after the tag,
+// using layout as time.Format does or one of the epoch layouts.
+func WithTimestamps(loc *time.Location, layout string) LineOption {
+	return func(lc *lineConfig) {
+		lc.timestamps = true
+		lc.timeLoc = loc
+		lc.timeLayout = layout
+	}
+}
+
+// WithMaxLine sets the longest line LineWriter will emit whole, longer lines
+// are truncated to n bytes and marked rather than aborting the stream.
+func WithMaxLine(n int) LineOption {
+	return func(lc *lineConfig) {
+		lc.maxLine = n
+	}
+}
+
+// WithKeepCR preserves each line's original terminator, including any
+// carriage return, instead of normalising it to a single newline.
+func WithKeepCR() LineOption {
+	return func(lc *lineConfig) {
+		lc.keepCR = true
+	}
+}
+
+// WithSplit splits the input into lines with split in place of at each
+// newline, the terminator it leaves on a token being written after the line.
+// WithKeepCR has no effect alongside it.
+func WithSplit(split bufio.SplitFunc) LineOption {
+	return func(lc *lineConfig) {
+		lc.split = split
+	}
+}
+
+// WithCounter increments n for every line written out.
+func WithCounter(n *atomic.Uint64) LineOption {
+	return func(lc *lineConfig) {
+		lc.counter = n
+	}
+}
+
+// WithStripANSI removes ANSI escape sequences containers write themselves so
+// they cannot clash with the writer's own colors.
+func WithStripANSI() LineOption {
+	return func(lc *lineConfig) {
+		lc.stripANSI = true
+	}
+}
+
+// WithRate limits LineWriter to perSecond lines a second, allowing bursts of
+// up to a second's worth. Excess lines are dropped and counted in a marker
+// line written before the next line let through.
+func WithRate(perSecond float64) LineOption {
+	return func(lc *lineConfig) {
+		lc.rate = perSecond
+	}
+}
+
+// WithDedupe collapses runs of identical messages, ignoring their
+// timestamps, into the first line followed by a note of how often it was
+// repeated.
+func WithDedupe() LineOption {
+	return func(lc *lineConfig) {
+		lc.dedupe = true
+	}
+}
+
+// WithMultiline joins lines not matching start, the pattern beginning a new
+// record such as a leading timestamp, onto the record before them so that
+// e.g. a stack trace is written as one block under a single prefix.
+func WithMultiline(start *regexp.Regexp) LineOption {
+	return func(lc *lineConfig) {
+		lc.multiline = start
+	}
+}
+
+// WithHighlight emphasises the matches of re within each line printed by
+// LineWriter using ANSI attributes.
+func WithHighlight(re *regexp.Regexp) LineOption {
+	return func(lc *lineConfig) {
+		lc.highlight = re
+	}
+}
+
+// WithTagAfter makes LineWriter write the tag after the message rather than
+// before the timestamp.
+func WithTagAfter() LineOption {
+	return func(lc *lineConfig) {
+		lc.tagAfter = true
+	}
+}
+
+// lineLimit caps the lines emitted by every writer sharing it, calling done
+// once the cap is reached.
+type lineLimit struct {
+	max     uint64
+	emitted atomic.Uint64
+	done    func()
+}
+
+// take reports whether another line may be emitted.
+func (l *lineLimit) take() bool {
+	n := l.emitted.Add(1)
+	if n == l.max {
+		l.done()
+	}
+	return n <= l.max
+}
+
+// withLineLimit caps the writer's lines by l as well as any other limits it
+// has, a line only counting against l once those allowed it.
+func withLineLimit(l *lineLimit) LineOption {
+	return func(lc *lineConfig) {
+		lc.limits = append(lc.limits, l)
+	}
+}
+
+// take reports whether every limit of lc allows another line.
+func (lc *lineConfig) take() bool {
+	for _, l := range lc.limits {
+		if !l.take() {
+			return false
+		}
+	}
+	return true
+}
+
+// sequence numbers the lines of every writer sharing it in the order they are
+// written. n is the number of the line being rendered while mu is held.
+type sequence struct {
+	mu sync.Mutex
+	n  uint64
+}
+
+// current is the number of the line being rendered, zero without a sequence.
+func (sq *sequence) current() uint64 {
+	if sq == nil {
+		return 0
+	}
+	return sq.n
+}
+
+// unused gives back the number of a line that was dropped rather than
+// written.
+func (sq *sequence) unused() {
+	if sq != nil {
+		sq.n--
+	}
+}
+
+// seqWidth is the digits sequence numbers are zero padded to.
+const seqWidth = 6
+
+func appendSeq(dst []byte, n uint64) []byte {
+	digits := strconv.AppendUint(nil, n, 10)
+	for i := len(digits); i < seqWidth; i++ {
+		dst = append(dst, '0')
+	}
+	return append(dst, digits...)
+}
+
+// withSequence numbers each line from sq, after the tag rather than leading
+// the line when after is set.
+func withSequence(sq *sequence, after bool) LineOption {
+	return func(lc *lineConfig) {
+		lc.seq = sq
+		lc.seqAfter = after
+	}
+}
+
+// WithErrors makes LineWriter report failures to write its lines, or to read
+// what is written to it, to w rather than discarding them.
+func WithErrors(w io.Writer) LineOption {
+	return func(lc *lineConfig) {
+		lc.errors = w
+	}
+}
+
+// WithDetails makes LineWriter parse the details docker prepends to each line
+// when LogsServiceOptions.Details is set, rendering them after the timestamp.
+func WithDetails() LineOption {
+	return func(lc *lineConfig) {
+		lc.details = true
+	}
+}
+
+// PrefixData is what a WithTemplate prefix is rendered from.
+type PrefixData struct {
+	StreamInfo
+	// ID is the short container ID.
+	ID string
+	// Time is the line's timestamp in the WithTimestamps layout, empty when
+	// timestamps are not parsed.
+	Time string
+	// Details are the line's docker details, nil unless WithDetails is set.
+	Details map[string]string
+	// Seq is the line's sequence number, zero unless lines are numbered.
+	Seq uint64
+}
+
+// WithTemplate replaces LineWriter's tag and timestamp prefix with tmpl
+// rendered for every line from info and the line's timestamp.
+func WithTemplate(tmpl *template.Template, info StreamInfo) LineOption {
+	return func(lc *lineConfig) {
+		lc.tmpl = tmpl
+		lc.info = info
+	}
+}
+
+// HealthcheckPattern matches the lines healthcheck probes typically leave in
+// access logs: requests for health, readiness and liveness endpoints and the
+// user agents of common probes. Lines merely mentioning health are kept.
+const HealthcheckPattern = `(?i)\b(?:GET|HEAD) /(?:health|healthz|healthcheck|ready|readyz|readiness|live|livez|liveness|ping)(?:[/?\s"]|$)|kube-probe/|ELB-HealthChecker/|GoogleHC/|Consul Health Check`
+
+// LineFilter decides which lines are printed. Its patterns are compiled once
+// and shared by every LineWriter.
+type LineFilter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// Keep reports whether msg matches Include (when set) and does not match
+// Exclude (when set).
+func (lf *LineFilter) Keep(msg []byte) bool {
+	if lf.Include != nil && !lf.Include.Match(msg) {
+		return false
+	}
+	if lf.Exclude != nil && lf.Exclude.Match(msg) {
+		return false
+	}
+	return true
+}
+
+// WithFilter drops every line whose message is rejected by lf.
+func WithFilter(lf *LineFilter) LineOption {
+	return func(lc *lineConfig) {
+		lc.filter = lf
+	}
+}
+
+// withUntil drops the lines stamped after until, calling pastUntil for each.
+// The docker timestamp is parsed to tell, but only rendered under
+// WithTimestamps.
+func withUntil(until time.Time, pastUntil func()) LineOption {
+	return func(lc *lineConfig) {
+		lc.until = until
+		lc.pastUntil = pastUntil
+	}
+}
+
+func newLineConfig(opts []LineOption) lineConfig {
+	lc := lineConfig{}
+	for _, opt := range opts {
+		opt(&lc)
+	}
+	return lc
+}
+
+// LineWriter prefixes every line written to it with Tag before writing it to
+// its destination. Its fields may be changed until the first Write or Close,
+// after which it keeps the configuration it started with. Close must be
+// called once the source is done to flush the final line.
+type LineWriter struct {
+	// Tag leads every line, or follows it with WithTagAfter.
+	Tag []byte
+	// Color colors each line's message, nil leaves it plain.
+	Color *color.Color
+	// Filter drops the lines it rejects, nil keeps every line. See
+	// WithFilter.
+	Filter *LineFilter
+	// Timestamps parses docker's timestamp from each line, rendering it in
+	// Location using Layout. See WithTimestamps.
+	Timestamps bool
+	Location   *time.Location
+	Layout     string
+	// Split splits the input into lines, nil to split at each newline. See
+	// WithSplit.
+	Split bufio.SplitFunc
+	// Options configure everything else. The fields above take precedence
+	// over any options setting the same behaviour.
+	Options []LineOption
+
+	w    io.Writer
+	once sync.Once
+	wc   io.WriteCloser
+}
+
+var _ io.WriteCloser = (*LineWriter)(nil)
+
+// NewLineWriter creates a LineWriter writing to w, its fields set from tag,
+// color and opts.
+func NewLineWriter(w io.Writer, tag []byte, color *color.Color, opts ...LineOption) *LineWriter {
+	lc := newLineConfig(opts)
+	return &LineWriter{
+		Tag:        tag,
+		Color:      color,
+		Filter:     lc.filter,
+		Timestamps: lc.timestamps,
+		Location:   lc.timeLoc,
+		Layout:     lc.timeLayout,
+		Split:      lc.split,
+		Options:    opts,
+		w:          w,
+	}
+}
+
+func (lw *LineWriter) Write(b []byte) (int, error) {
+	lw.once.Do(lw.start)
+	return lw.wc.Write(b)
+}
+
+// Close flushes the final line and waits for every line to be written.
+func (lw *LineWriter) Close() error {
+	lw.once.Do(lw.start)
+	return lw.wc.Close()
+}
+
+// start fixes lw's configuration and starts splitting its input.
+func (lw *LineWriter) start() {
+	lc := newLineConfig(lw.Options)
+	lc.filter = lw.Filter
+	lc.timestamps = lw.Timestamps
+	lc.timeLoc = lw.Location
+	lc.timeLayout = lw.Layout
+	lc.split = lw.Split
+	lw.wc = lineWriter(lw.w, lw.Tag, lw.Color, lc)
+}
+
+// lineWriter is LineWriter once configured.
+func lineWriter(w io.Writer, tag []byte, color *color.Color, lc lineConfig) io.WriteCloser {
+	var prefix func(dst []byte, ts time.Time, details map[string]string) []byte
+	if lc.tmpl != nil {
+		data := PrefixData{
+			StreamInfo: lc.info,
+			ID:         shortID(lc.info.Container),
+		}
+		var buf bytes.Buffer
+		prefix = func(dst []byte, ts time.Time, details map[string]string) []byte {
+			data.Time = ""
+			if !ts.IsZero() {
+				data.Time = string(appendTime(nil, ts, lc.timeLayout))
+			}
+			data.Details = details
+			data.Seq = lc.seq.current()
+			buf.Reset()
+			if err := lc.tmpl.Execute(&buf, data); err != nil {
+				return append(dst, tag...)
+			}
+			return append(dst, buf.Bytes()...)
+		}
+	} else {
+		prefix = func(dst []byte, ts time.Time, details map[string]string) []byte {
+			seq := lc.seq.current()
+			if seq > 0 && !lc.seqAfter {
+				dst = append(appendSeq(dst, seq), ' ')
+			}
+			if !lc.tagAfter {
+				dst = append(dst, tag...)
+				if seq > 0 && lc.seqAfter {
+					dst = append(appendSeq(dst, seq), ' ')
+				}
+			}
+			if !ts.IsZero() {
+				dst = appendTime(dst, ts, lc.timeLayout)
+				dst = append(dst, ' ')
+			}
+			for i, key := range sortedKeys(details) {
+				if i > 0 {
+					dst = append(dst, ',')
+				}
+				dst = append(append(append(dst, key...), '='), details[key]...)
+			}
+			if len(details) > 0 {
+				dst = append(dst, ' ')
+			}
+			return dst
+		}
+	}
+
+	return pipeLines(w, lc, func(dst []byte, ts time.Time, details map[string]string, msg []byte) []byte {
+		// tag is shared between every line of the stream (and possibly other
+		// streams) so the line is always assembled in dst
+		line := prefix(dst, ts, details)
+		switch {
+		case lc.highlight != nil:
+			line = append(line, highlightMatches(msg, lc.highlight, color)...)
+		case color != nil:
+			line = append(line, color.Sprint(string(msg))...)
+		default:
+			line = append(line, msg...)
+		}
+		if lc.tagAfter && lc.tmpl == nil {
+			line = append(line, tag...)
+			if seq := lc.seq.current(); seq > 0 && lc.seqAfter {
+				line = appendSeq(append(line, ' '), seq)
+			}
+		}
+		return line
+	})
+}
+
+// matchColor marks the spans WithHighlight picks out.
+var matchColor = color.New(color.Bold, color.Underline)
+
+// highlightMatches wraps the matches of re in msg with matchColor, coloring
+// the text between them with c when set. Each span is colored on its own so
+// that a match's reset does not end the line's color.
+func highlightMatches(msg []byte, re *regexp.Regexp, c *color.Color) []byte {
+	paint := func(b []byte) string { return string(b) }
+	if c != nil {
+		paint = func(b []byte) string { return c.Sprint(string(b)) }
+	}
+
+	var out []byte
+	var last int
+	for _, m := range re.FindAllIndex(msg, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		if m[0] > last {
+			out = append(out, paint(msg[last:m[0]])...)
+		}
+		out = append(out, matchColor.Sprint(string(msg[m[0]:m[1]]))...)
+		last = m[1]
+	}
+	if last < len(msg) || len(out) == 0 {
+		out = append(out, paint(msg[last:])...)
+	}
+	return out
+}
+
+// RawWriter passes everything written to it through to w untouched, without
+// tagging or coloring. It is passed on whole lines at a time, holding back a
+// partial line until the rest of it is written, so that raw output from
+// several streams sharing a FanInWriter never interleaves mid line. Lines end
+// at \n or, as progress output redraws in place, \r, and one growing past
+// maxRawPartial is passed on in pieces. Close writes out any partial line
+// left.
+func RawWriter(w io.Writer) io.WriteCloser {
+	return &rawWriter{w: w}
+}
+
+// maxRawPartial bounds the partial line a RawWriter holds back.
+const maxRawPartial = bufio.MaxScanTokenSize
+
+type rawWriter struct {
+	w       io.Writer
+	partial []byte
+}
+
+func (rw *rawWriter) Write(b []byte) (int, error) {
+	end := bytes.LastIndexAny(b, "\n\r") + 1
+	if end == 0 {
+		rw.partial = append(rw.partial, b...)
+		if len(rw.partial) < maxRawPartial {
+			return len(b), nil
+		}
+		return len(b), rw.flush()
+	}
+
+	if len(rw.partial) > 0 {
+		// the held back start of the line goes out in the same write as
+		// its end
+		rw.partial = append(rw.partial, b[:end]...)
+		if err := rw.flush(); err != nil {
+			return 0, err
+		}
+	} else if _, err := fullWrite(rw.w, b[:end]); err != nil {
+		return 0, err
+	}
+	rw.partial = append(rw.partial, b[end:]...)
+	return len(b), nil
+}
+
+// flush writes out the partial line held back.
+func (rw *rawWriter) flush() error {
+	if len(rw.partial) == 0 {
+		return nil
+	}
+	_, err := fullWrite(rw.w, rw.partial)
+	rw.partial = rw.partial[:0]
+	return err
+}
+
+func (rw *rawWriter) Close() error {
+	return rw.flush()
+}
+
+// StreamInfo identifies the container and stream a structured log line came
+// from.
+type StreamInfo struct {
+	Service   string `json:"service,omitempty"`
+	Task      string `json:"task,omitempty"`
+	Container string `json:"container"`
+	Stream    string `json:"stream"`
+}
+
+type jsonLine struct {
+	Seq uint64 `json:"seq,omitempty"`
+	StreamInfo
+	Time    *time.Time        `json:"time,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Message string            `json:"message"`
+}
+
+// JSONLineWriter is the structured counterpart to LineWriter, emitting each
+// line as a newline delimited JSON object describing its origin.
+func JSONLineWriter(w io.Writer, info StreamInfo, opts ...LineOption) io.WriteCloser {
+	lc := newLineConfig(opts)
+
+	return pipeLines(w, lc, func(dst []byte, ts time.Time, details map[string]string, msg []byte) []byte {
+		jl := jsonLine{
+			Seq:        lc.seq.current(),
+			StreamInfo: info,
+			Details:    details,
+			Message:    string(msg),
+		}
+		if !ts.IsZero() {
+			jl.Time = &ts
+		}
+
+		line, err := json.Marshal(jl)
+		if err != nil {
+			// drop the line rather than the stream
+			return nil
+		}
+		return append(dst, line...)
+	})
+}
+
+// LogfmtLineWriter is like JSONLineWriter but emits each line as logfmt
+// key=value pairs, quoting values where needed.
+func LogfmtLineWriter(w io.Writer, info StreamInfo, opts ...LineOption) io.WriteCloser {
+	lc := newLineConfig(opts)
+
+	return pipeLines(w, lc, func(dst []byte, ts time.Time, details map[string]string, msg []byte) []byte {
+		line := dst
+		if seq := lc.seq.current(); seq > 0 {
+			line = appendLogfmt(line, "seq", strconv.FormatUint(seq, 10))
+		}
+		if !ts.IsZero() {
+			line = appendLogfmt(line, "time", ts.Format(time.RFC3339Nano))
+		}
+		if info.Service != "" {
+			line = appendLogfmt(line, "service", info.Service)
+		}
+		if info.Task != "" {
+			line = appendLogfmt(line, "task", info.Task)
+		}
+		line = appendLogfmt(line, "container", info.Container)
+		line = appendLogfmt(line, "stream", info.Stream)
+		for _, key := range sortedKeys(details) {
+			line = appendLogfmt(line, key, details[key])
+		}
+		return appendLogfmt(line, "msg", string(msg))
+	})
+}
+
+// appendLogfmt appends key=value to line, space separated from any earlier
+// pair. Values that are empty or contain spaces, quotes, '=' or non-printable
+// characters are quoted.
+func appendLogfmt(line []byte, key, value string) []byte {
+	if len(line) > 0 {
+		line = append(line, ' ')
+	}
+	line = append(line, key...)
+	line = append(line, '=')
+
+	needsQuote := value == ""
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			needsQuote = true
+			break
+		}
+	}
+	if needsQuote {
+		return strconv.AppendQuote(line, value)
+	}
+	return append(line, value...)
+}
+
+// pipeWriter is the writing end of a pipeLines pipe, Close blocks until every
+// line written has been rendered. The reader drains the pipe to EOF before
+// signalling done, so the last lines docker sends before ending a stream are
+// always written.
+type pipeWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (pw *pipeWriter) Close() error {
+	err := pw.PipeWriter.Close()
+	<-pw.done
+	return err
+}
+
+// linePool recycles the buffers lines are assembled in. Lines longer than
+// maxPooledLine are left to the garbage collector.
+var linePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+const maxPooledLine = 64 << 10
+
+// pipeLines returns a writer whose input is split into lines, each passed to
+// render along with its docker timestamp (zero when not parsed) and the result
+// written to w followed by the line terminator. render appends the line to
+// dst, which is reused once the line is written. Whichever split function is
+// in use, a final line left without a terminator when the writer is closed is
+// still written, given a plain newline.
+func pipeLines(w io.Writer, lc lineConfig, render func(dst []byte, ts time.Time, details map[string]string, msg []byte) []byte) io.WriteCloser {
+	r, in := io.Pipe()
+	pw := &pipeWriter{
+		PipeWriter: in,
+		done:       make(chan struct{}),
+	}
+
+	errOut := lc.errors
+	if errOut == nil {
+		errOut = io.Discard
+	}
+
+	go func() {
+		defer close(pw.done)
+
+		maxLine := lc.maxLine
+		if maxLine <= 0 {
+			maxLine = bufio.MaxScanTokenSize
+		}
+
+		split := lc.split
+		switch {
+		case split != nil:
+		case lc.keepCR:
+			split = scanLinesKeepCR
+		default:
+			split = bufio.ScanLines
+		}
+
+		emit := func(ts time.Time, details map[string]string, msg, term []byte) error {
+			if lc.seq != nil {
+				// numbering and writing under one lock keeps the numbers in
+				// the order lines are written
+				lc.seq.mu.Lock()
+				defer lc.seq.mu.Unlock()
+				lc.seq.n++
+			}
+
+			if lc.merge != nil {
+				// the merger holds on to lines so they cannot be recycled
+				line := render(nil, ts, details, msg)
+				if len(line) == 0 {
+					lc.seq.unused()
+					return nil
+				}
+				return lc.merge.add(w, ts, append(line, term...))
+			}
+
+			buf := linePool.Get().(*[]byte)
+			line := render((*buf)[:0], ts, details, msg)
+			if len(line) == 0 {
+				lc.seq.unused()
+				linePool.Put(buf)
+				return nil
+			}
+			line = append(line, term...)
+			_, err := fullWrite(w, line)
+			if cap(line) <= maxPooledLine {
+				*buf = line[:0]
+				linePool.Put(buf)
+			}
+			return err
+		}
+
+		var bucket *tokenBucket
+		if lc.rate > 0 {
+			bucket = newTokenBucket(lc.rate)
+		}
+		var suppressed int
+
+		var (
+			last     []byte
+			lastTS   time.Time
+			haveLast bool
+			repeats  int
+		)
+
+		// process takes one logical line through filtering, collapsing and
+		// rate limiting to the writer
+		process := func(ts time.Time, details map[string]string, msg, term []byte) error {
+			if lc.filter != nil && !lc.filter.Keep(msg) {
+				return nil
+			}
+
+			if lc.dedupe {
+				if haveLast && bytes.Equal(msg, last) {
+					// the note carries the time of the final repeat
+					repeats++
+					lastTS = ts
+					return nil
+				}
+				if repeats > 0 {
+					if err := emit(lastTS, nil, repeatedMessage(repeats), newline); err != nil {
+						return err
+					}
+					repeats = 0
+				}
+				last, lastTS, haveLast = append(last[:0], msg...), ts, true
+			}
+
+			if bucket != nil {
+				if !bucket.take(time.Now()) {
+					suppressed++
+					return nil
+				}
+				if suppressed > 0 {
+					if err := emit(ts, nil, suppressedMessage(suppressed), newline); err != nil {
+						return err
+					}
+					suppressed = 0
+				}
+			}
+
+			if !lc.take() {
+				return nil
+			}
+			if err := emit(ts, details, msg, term); err != nil {
+				return err
+			}
+			if lc.counter != nil {
+				lc.counter.Add(1)
+			}
+			return nil
+		}
+
+		// with multiline continuation lines are held back and joined onto
+		// the record they follow
+		var (
+			record        []byte
+			recordTS      time.Time
+			recordDetails map[string]string
+			recordTerm    []byte
+			haveRecord    bool
+		)
+		flush := func() error {
+			if !haveRecord {
+				return nil
+			}
+			haveRecord = false
+			return process(recordTS, recordDetails, record, recordTerm)
+		}
+
+		var truncated bool
+		scan := bufio.NewScanner(r)
+		scan.Buffer(make([]byte, 0, 4096), maxLine)
+		scan.Split(truncateLines(maxLine, split, &truncated))
+
+		err := func() error {
+			for scan.Scan() {
+				msg, term := splitTerminator(scan.Bytes())
+				if truncated {
+					msg = append(msg[:len(msg):len(msg)], truncatedMarker...)
+					truncated = false
+				}
+
+				var ts time.Time
+				if lc.timestamps || !lc.until.IsZero() {
+					ts, msg = splitTimestamp(msg, lc.timeLoc)
+				}
+				if !lc.until.IsZero() {
+					if ts.After(lc.until) {
+						lc.pastUntil()
+						continue
+					}
+					if !lc.timestamps {
+						ts = time.Time{}
+					}
+				}
+				var details map[string]string
+				if lc.details {
+					details, msg = splitDetails(msg)
+				}
+				if lc.stripANSI {
+					msg = ansiCSI.ReplaceAll(msg, nil)
+				}
+
+				if lc.multiline == nil {
+					if err := process(ts, details, msg, term); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if haveRecord && !lc.multiline.Match(msg) && len(record)+len(msg) < maxLine {
+					record = append(append(record, '\n'), msg...)
+					continue
+				}
+				if err := flush(); err != nil {
+					return err
+				}
+				record = append(record[:0], msg...)
+				recordTS, recordDetails, recordTerm, haveRecord = ts, details, append(recordTerm[:0], term...), true
+			}
+			return flush()
+		}()
+		if err != nil {
+			fmt.Fprintf(errOut, "Error attempting to write to dest: %s\n", err)
+			// unblock the source rather than leaving it writing to a pipe
+			// nobody reads
+			r.CloseWithError(err)
+			return
+		}
+
+		if repeats > 0 {
+			emit(lastTS, nil, repeatedMessage(repeats), newline)
+		}
+		if suppressed > 0 {
+			emit(time.Time{}, nil, suppressedMessage(suppressed), newline)
+		}
+		if scanErr := scan.Err(); scanErr != nil {
+			fmt.Fprintf(errOut, "Error receiving write from source: %s\n", scanErr)
+			r.CloseWithError(scanErr)
+		}
+	}()
+
+	return pw
+}
+
+// tokenBucket allows rate takes a second with bursts of up to rate, or one
+// take for rates below one a second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take reports whether a token was available at now, consuming it.
+func (tb *tokenBucket) take(now time.Time) bool {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func repeatedMessage(n int) []byte {
+	return []byte(dim.Sprintf("(repeated %dx)", n))
+}
+
+func suppressedMessage(n int) []byte {
+	return []byte(dim.Sprintf("… %d lines suppressed", n))
+}
+
+// appendTime appends t rendered with layout, a time.Format layout or one of
+// the epoch layouts.
+func appendTime(dst []byte, t time.Time, layout string) []byte {
+	switch layout {
+	case TimeLayoutEpoch:
+		return strconv.AppendInt(dst, t.Unix(), 10)
+	case TimeLayoutEpochMillis:
+		return strconv.AppendInt(dst, t.UnixMilli(), 10)
+	default:
+		return t.AppendFormat(dst, layout)
+	}
+}
+
+// splitTimestamp separates the leading docker timestamp from line, returning
+// it converted to loc along with the remaining message. If no timestamp can be
+// parsed a zero time and the untouched line are returned.
+func splitTimestamp(line []byte, loc *time.Location) (time.Time, []byte) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		i = len(line)
+	}
+
+	t, err := time.Parse(dockerTimeLayout, string(line[:i]))
+	if err != nil {
+		return time.Time{}, line
+	}
+
+	if loc != nil {
+		t = t.In(loc)
+	}
+
+	if i < len(line) {
+		i++
+	}
+
+	return t, line[i:]
+}
+
+// splitDetails separates the details docker puts before line, comma
+// separated key=value pairs with query escaped values followed by a space,
+// returning them along with the remaining message. A line not led by details
+// is returned untouched.
+func splitDetails(line []byte) (map[string]string, []byte) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, line
+	}
+	if i == 0 {
+		// the line carries no details
+		return nil, line[1:]
+	}
+
+	details := map[string]string{}
+	for _, pair := range strings.Split(string(line[:i]), ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, line
+		}
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		details[key] = value
+	}
+	return details, line[i+1:]
+}
+
+func sortedKeys(m map[string]string) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ansiCSI matches ANSI control sequences such as color codes.
+var ansiCSI = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]`)
+
+var newline = []byte("\n")
+
+// splitTerminator separates any line terminator left on token by the split
+// function. Tokens without one are given a plain newline.
+func splitTerminator(token []byte) (msg, term []byte) {
+	i := len(token)
+	if i > 0 && token[i-1] == '\n' {
+		i--
+		if i > 0 && token[i-1] == '\r' {
+			i--
+		}
+	}
+	if i == len(token) {
+		return token, newline
+	}
+	return token[:i], token[i:]
+}
+
+const truncatedMarker = " …[truncated]"
+
+// truncateLines wraps split so that a line which would overflow the scanner's
+// max buffer size is returned cut at max bytes, flagging truncated, and the
+// remainder of the line is discarded.
+func truncateLines(max int, split bufio.SplitFunc, truncated *bool) bufio.SplitFunc {
+	var discarding bool
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if discarding {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				discarding = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+
+		advance, token, err = split(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= max {
+			discarding = true
+			*truncated = true
+			return len(data), data[:max], nil
+		}
+		if len(token) > max {
+			*truncated = true
+			token = token[:max]
+		}
+		return advance, token, err
+	}
+}
+
+func scanLinesKeepCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		// We have a full newline-terminated line.
+		return i + 1, data[0 : i+1], nil
+	}
+	// If we're at EOF, we have a final, non-terminated line. Return it.
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data.
+	return 0, nil, nil
+}
+
+// FanInWriter lets many streams share one writer. Each Write is written out
+// in full, however many writes the destination takes, before any other
+// begins. Writers must hand it whole lines, as LineWriter, RawWriter and the
+// structured writers do, for their lines never to be interleaved.
+type FanInWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewFanInWriter creates a FanInWriter over w, nil when w is.
+func NewFanInWriter(w io.Writer) *FanInWriter {
+	if w == nil {
+		return nil
+	}
+
+	return &FanInWriter{
+		out: w,
+	}
+}
+
+func (fiw *FanInWriter) Write(b []byte) (n int, err error) {
+	fiw.mu.Lock()
+	n, err = fullWrite(fiw.out, b)
+	fiw.mu.Unlock()
+	return
+}
+
+// sameWriter reports whether a and b are the same destination.
+func sameWriter(a, b io.Writer) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+func fullWrite(w io.Writer, b []byte) (n int, err error) {
+	for n < len(b) {
+		lw, err := w.Write(b[n:])
+		n += lw
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,637 @@
+package dla
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// writeAll writes in to a LineWriter tagging lines with tag in one Write and
+// closes it, returning what it wrote to its destination.
+func writeAll(t *testing.T, in, tag string, opts ...LineOption) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	w := NewLineWriter(&out, []byte(tag), nil, opts...)
+	if _, err := w.Write([]byte(in)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return out.String()
+}
+
+func TestLineWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+		in   string
+		opts []LineOption
+		want string
+	}{
+		{
+			name: "tags every line",
+			in:   "one\ntwo\n",
+			want: "t | one\nt | two\n",
+		},
+		{
+			name: "drops carriage returns before newlines",
+			in:   "one\r\ntwo\n",
+			want: "t | one\nt | two\n",
+		},
+		{
+			name: "keeps carriage returns",
+			in:   "one\r\nprog\r50%\rdone\n",
+			opts: []LineOption{WithKeepCR()},
+			want: "t | one\r\nt | prog\r50%\rdone\n",
+		},
+		{
+			name: "truncates lines past max line",
+			in:   strings.Repeat("x", 30) + "\nnext\n",
+			opts: []LineOption{WithMaxLine(10)},
+			want: "t | xxxxxxxxxx" + truncatedMarker + "\nt | next\n",
+		},
+		{
+			name: "truncates lines past the default max line",
+			in:   strings.Repeat("x", 2*bufio.MaxScanTokenSize) + "\nnext\n",
+			want: "t | " + strings.Repeat("x", bufio.MaxScanTokenSize) + truncatedMarker + "\nt | next\n",
+		},
+		{
+			name: "renders timestamps",
+			in:   "2020-01-01T00:00:01.5Z hi\n",
+			opts: []LineOption{WithTimestamps(time.UTC, "15:04:05.000")},
+			want: "t | 00:00:01.500 hi\n",
+		},
+		{
+			name: "tag after",
+			tag:  " | t",
+			in:   "one\n",
+			opts: []LineOption{WithTagAfter()},
+			want: "one | t\n",
+		},
+		{
+			name: "dedupes repeats",
+			in:   "a\na\na\nb\n",
+			opts: []LineOption{WithDedupe()},
+			want: "t | a\nt | (repeated 2x)\nt | b\n",
+		},
+		{
+			name: "filters lines",
+			in:   "keep\ndrop\nkeep too\n",
+			opts: []LineOption{WithFilter(&LineFilter{Include: regexp.MustCompile("keep")})},
+			want: "t | keep\nt | keep too\n",
+		},
+		{
+			name: "counts the lines past the rate",
+			in:   "1\n2\n3\n4\n5\n",
+			opts: []LineOption{WithRate(2)},
+			want: "t | 1\nt | 2\nt | … 3 lines suppressed\n",
+		},
+		{
+			name: "bursts one line below one a second",
+			in:   "1\n2\n3\n",
+			opts: []LineOption{WithRate(0.5)},
+			want: "t | 1\nt | … 2 lines suppressed\n",
+		},
+		{
+			name: "strips escape codes",
+			in:   "\x1b[1;31merror\x1b[0m: disk\x1b[K full\n",
+			opts: []LineOption{WithStripANSI()},
+			want: "t | error: disk full\n",
+		},
+		{
+			name: "strips escape codes after the timestamp",
+			in:   "2020-01-01T00:00:01.5Z \x1b[32mok\x1b[m\n",
+			opts: []LineOption{WithTimestamps(time.UTC, "15:04:05.000"), WithStripANSI()},
+			want: "t | 00:00:01.500 ok\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := tt.tag
+			if tag == "" {
+				tag = "t | "
+			}
+			if got := writeAll(t, tt.in, tag, tt.opts...); got != tt.want {
+				t.Errorf("LineWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineWriterHighlight(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	re := regexp.MustCompile("disk")
+	red := color.New(color.FgRed)
+	tests := []struct {
+		name  string
+		color *color.Color
+		in    string
+		want  string
+	}{
+		{
+			name: "wraps matches",
+			in:   "no disk left on disk0\n",
+			want: "t | no " + matchColor.Sprint("disk") + " left on " + matchColor.Sprint("disk") + "0\n",
+		},
+		{
+			name:  "colors around matches",
+			color: red,
+			in:    "no disk left\n",
+			want:  "t | " + red.Sprint("no ") + matchColor.Sprint("disk") + red.Sprint(" left") + "\n",
+		},
+		{
+			name: "leaves other lines alone",
+			in:   "all good\n",
+			want: "t | all good\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewLineWriter(&out, []byte("t | "), tt.color, WithHighlight(re))
+			if _, err := w.Write([]byte(tt.in)); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("LineWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineWriterRateResumes(t *testing.T) {
+	var out bytes.Buffer
+	w := NewLineWriter(&out, []byte("t | "), nil, WithRate(10))
+	w.Write([]byte(strings.Repeat("burst\n", 15)))
+	// time for the bucket to hold a line again
+	time.Sleep(300 * time.Millisecond)
+	w.Write([]byte("next\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := strings.Repeat("t | burst\n", 10) + "t | … 5 lines suppressed\nt | next\n"
+	if got := out.String(); got != want {
+		t.Errorf("LineWriter wrote %q, want %q", got, want)
+	}
+}
+
+func TestLineWriterSharedTag(t *testing.T) {
+	// a tag with spare capacity is what would be grown in place if lines were
+	// appended to it
+	tag := make([]byte, 0, 64)
+	tag = append(tag, "shared | "...)
+
+	var out bytes.Buffer
+	fan := NewFanInWriter(&out)
+
+	const writers, lines = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := NewLineWriter(fan, tag, nil)
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(w, "writer %d line %d\n", i, j)
+			}
+			w.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(got) != writers*lines {
+		t.Fatalf("got %d lines, want %d", len(got), writers*lines)
+	}
+	line := regexp.MustCompile(`^shared \| writer \d+ line \d+$`)
+	for _, l := range got {
+		if !line.MatchString(l) {
+			t.Fatalf("corrupted line %q", l)
+		}
+	}
+}
+
+func TestSplitDetails(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantDetails map[string]string
+		wantMsg     string
+	}{
+		{
+			name:        "single pair",
+			line:        "com.docker.swarm.task.id=abc hello\n",
+			wantDetails: map[string]string{"com.docker.swarm.task.id": "abc"},
+			wantMsg:     "hello\n",
+		},
+		{
+			name:        "several pairs",
+			line:        "env=prod,region=eu hello world\n",
+			wantDetails: map[string]string{"env": "prod", "region": "eu"},
+			wantMsg:     "hello world\n",
+		},
+		{
+			name:        "query escaped",
+			line:        "team%3Dx=a%2Cb,msg=two%20words hello\n",
+			wantDetails: map[string]string{"team=x": "a,b", "msg": "two words"},
+			wantMsg:     "hello\n",
+		},
+		{
+			name:    "empty details",
+			line:    " hello\n",
+			wantMsg: "hello\n",
+		},
+		{
+			name:    "no details",
+			line:    "hello world\n",
+			wantMsg: "hello world\n",
+		},
+		{
+			name:    "no space",
+			line:    "hello",
+			wantMsg: "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details, msg := splitDetails([]byte(tt.line))
+			if !reflect.DeepEqual(details, tt.wantDetails) {
+				t.Errorf("splitDetails() details = %v, want %v", details, tt.wantDetails)
+			}
+			if string(msg) != tt.wantMsg {
+				t.Errorf("splitDetails() msg = %q, want %q", msg, tt.wantMsg)
+			}
+		})
+	}
+}
+
+// writeRecorder records each Write it is handed.
+type writeRecorder struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (wr *writeRecorder) Write(p []byte) (int, error) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.writes = append(wr.writes, string(p))
+	return len(p), nil
+}
+
+func TestRawWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{name: "whole lines", chunks: []string{"one\n", "two\nthree\n"}, want: []string{"one\n", "two\nthree\n"}},
+		{name: "split line", chunks: []string{"o", "ne\ntw", "o\n"}, want: []string{"one\n", "two\n"}},
+		{name: "carriage returns", chunks: []string{"10%\r", "50", "%\r100%\n"}, want: []string{"10%\r", "50%\r100%\n"}},
+		{name: "unterminated end", chunks: []string{"one\nla", "st"}, want: []string{"one\n", "last"}},
+		{
+			name:   "long partial line",
+			chunks: []string{strings.Repeat("x", maxRawPartial-1), "xx", "x\n"},
+			want:   []string{strings.Repeat("x", maxRawPartial+1), "x\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec writeRecorder
+			w := RawWriter(&rec)
+			for _, chunk := range tt.chunks {
+				if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if !reflect.DeepEqual(rec.writes, tt.want) {
+				t.Errorf("writes = %q, want %q", rec.writes, tt.want)
+			}
+		})
+	}
+}
+
+// shortWriter takes at most a few bytes of each Write, as a slow pipe can.
+type shortWriter struct {
+	b bytes.Buffer
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return sw.b.Write(p)
+}
+
+func TestFanInWriterConcurrent(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		t.Run(fmt.Sprintf("raw=%v", raw), func(t *testing.T) {
+			var out shortWriter
+			fan := NewFanInWriter(&out)
+
+			const writers, lines = 8, 200
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var w io.WriteCloser = NewLineWriter(fan, []byte("t | "), nil)
+					if raw {
+						w = RawWriter(fan)
+					}
+					// each line is handed over in pieces, as docker's frames
+					// need not end at line ends
+					for j := 0; j < lines; j++ {
+						line := fmt.Sprintf("t | writer %d line %d\n", i, j)
+						if !raw {
+							line = line[len("t | "):]
+						}
+						for len(line) > 0 {
+							n := 1 + (i+j)%5
+							if n > len(line) {
+								n = len(line)
+							}
+							w.Write([]byte(line[:n]))
+							line = line[n:]
+						}
+					}
+					w.Close()
+				}(i)
+			}
+			wg.Wait()
+
+			got := strings.Split(strings.TrimSuffix(out.b.String(), "\n"), "\n")
+			if len(got) != writers*lines {
+				t.Fatalf("got %d lines, want %d", len(got), writers*lines)
+			}
+			line := regexp.MustCompile(`^t \| writer \d+ line \d+$`)
+			for _, l := range got {
+				if !line.MatchString(l) {
+					t.Fatalf("interleaved line %q", l)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitTerminator(t *testing.T) {
+	tests := []struct {
+		token    string
+		wantMsg  string
+		wantTerm string
+	}{
+		{token: "line\n", wantMsg: "line", wantTerm: "\n"},
+		{token: "line\r\n", wantMsg: "line", wantTerm: "\r\n"},
+		{token: "line", wantMsg: "line", wantTerm: "\n"},
+		{token: "line\r", wantMsg: "line\r", wantTerm: "\n"},
+		{token: "\n", wantMsg: "", wantTerm: "\n"},
+		{token: "", wantMsg: "", wantTerm: "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.token), func(t *testing.T) {
+			msg, term := splitTerminator([]byte(tt.token))
+			if string(msg) != tt.wantMsg || string(term) != tt.wantTerm {
+				t.Errorf("splitTerminator() = %q, %q, want %q, %q", msg, term, tt.wantMsg, tt.wantTerm)
+			}
+		})
+	}
+}
+
+func TestLineWriterFinalLine(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []LineOption
+		in   []string
+		want string
+	}{
+		{
+			name: "default split",
+			in:   []string{"one\nla", "st"},
+			want: "t | one\nt | last\n",
+		},
+		{
+			name: "keep cr",
+			opts: []LineOption{WithKeepCR()},
+			in:   []string{"one\r\nla", "st"},
+			want: "t | one\r\nt | last\n",
+		},
+		{
+			name: "custom split",
+			opts: []LineOption{WithSplit(bufio.ScanLines)},
+			in:   []string{"one\nla", "st"},
+			want: "t | one\nt | last\n",
+		},
+		{
+			name: "multiline record",
+			opts: []LineOption{WithMultiline(regexp.MustCompile(`^\S`))},
+			in:   []string{"start\n  more\n  la", "st"},
+			want: "t | start\n  more\n  last\n",
+		},
+		{
+			name: "dedupe",
+			opts: []LineOption{WithDedupe()},
+			in:   []string{"same\nsame\nsa", "me"},
+			want: "t | same\nt | (repeated 2x)\n",
+		},
+		{
+			name: "only a partial line",
+			in:   []string{"la", "st"},
+			want: "t | last\n",
+		},
+		{
+			name: "empty stream",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewLineWriter(&out, []byte("t | "), nil, tt.opts...)
+			for _, chunk := range tt.in {
+				w.Write([]byte(chunk))
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("LineWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchLines writes b.N lines to a LineWriter over io.Discard configured
+// with opts, one Write per line as docker's frames usually carry.
+func benchLines(b *testing.B, line string, opts ...LineOption) {
+	w := NewLineWriter(io.Discard, []byte("web.1.abc123 | "), nil, opts...)
+	p := []byte(line)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkLineWriterPrefix(b *testing.B) {
+	const line = "GET /api/v1/items?page=2 200 1.873ms\n"
+	stamped := "2020-01-01T00:00:01.123456789Z " + line
+
+	b.Run("tag", func(b *testing.B) {
+		benchLines(b, line)
+	})
+	b.Run("tag after", func(b *testing.B) {
+		benchLines(b, line, WithTagAfter())
+	})
+	b.Run("seq", func(b *testing.B) {
+		benchLines(b, line, withSequence(&sequence{}, false))
+	})
+	b.Run("timestamps", func(b *testing.B) {
+		benchLines(b, stamped, WithTimestamps(time.UTC, "15:04:05.000"))
+	})
+	b.Run("template", func(b *testing.B) {
+		tmpl := template.Must(template.New("prefix").Parse("{{.Service}} {{.ID}} | "))
+		benchLines(b, line, WithTemplate(tmpl, StreamInfo{Service: "web", Container: "abc123def456"}))
+	})
+}
+
+func BenchmarkTagLookup(b *testing.B) {
+	entries := make([]tagEntry, 0, 50)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, tagEntry{id: fmt.Sprintf("%012d", i), tag: fmt.Sprintf("web.%d", i)})
+	}
+	tagFmt := tagConfig(entries, tagStyle{sep: DefaultSeparator}, nil)
+	msg := []byte("GET /api/v1/items?page=2 200 1.873ms")
+	id, name := entries[17].id, entries[17].tag
+
+	// looking the tag up for every line, as streams once did, against
+	// resolving it when the stream starts
+	b.Run("per line", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []byte
+		for i := 0; i < b.N; i++ {
+			dst = append(append(dst[:0], tagFmt(id, name)...), msg...)
+		}
+	})
+	b.Run("resolved", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []byte
+		tag := tagFmt(id, name)
+		for i := 0; i < b.N; i++ {
+			dst = append(append(dst[:0], tag...), msg...)
+		}
+	})
+}
+
+func BenchmarkLinePool(b *testing.B) {
+	tag := []byte("web.1.abc123 | ")
+	msg := []byte("GET /api/v1/items?page=2 200 1.873ms")
+
+	// assembling each line in a recycled buffer, as pipeLines does, against
+	// allocating one per line
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := linePool.Get().(*[]byte)
+			line := append(append(append((*buf)[:0], tag...), msg...), '\n')
+			io.Discard.Write(line)
+			*buf = line[:0]
+			linePool.Put(buf)
+		}
+	})
+	b.Run("allocated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			line := append(append(append([]byte(nil), tag...), msg...), '\n')
+			io.Discard.Write(line)
+		}
+	})
+}
+
+func BenchmarkLineWriterStream(b *testing.B) {
+	const lines = 1000
+	var stream bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&stream, "GET /api/v1/items?page=%d 200 1.873ms\n", i)
+	}
+	info := StreamInfo{Service: "web", Task: "web.1", Container: "abc123def456", Stream: "stdout"}
+
+	writers := []struct {
+		name string
+		new  func() io.WriteCloser
+	}{
+		{name: "text", new: func() io.WriteCloser { return NewLineWriter(io.Discard, []byte("web.1 | "), nil) }},
+		{name: "json", new: func() io.WriteCloser { return JSONLineWriter(io.Discard, info) }},
+		{name: "logfmt", new: func() io.WriteCloser { return LogfmtLineWriter(io.Discard, info) }},
+	}
+
+	// each op is a whole stream of lines, so allocs/op divided by lines is
+	// what a line costs
+	for _, w := range writers {
+		b.Run(w.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(stream.Len()))
+			for i := 0; i < b.N; i++ {
+				wc := w.new()
+				wc.Write(stream.Bytes())
+				if err := wc.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// failWriter fails every Write with err.
+type failWriter struct {
+	err error
+}
+
+func (fw failWriter) Write(p []byte) (int, error) {
+	return 0, fw.err
+}
+
+func TestLineWriterErrors(t *testing.T) {
+	var errs bytes.Buffer
+	w := NewLineWriter(failWriter{errors.New("disk full")}, []byte("t | "), nil, WithErrors(&errs))
+	w.Write([]byte("one\n"))
+	w.Close()
+
+	if got, want := errs.String(), "Error attempting to write to dest: disk full\n"; got != want {
+		t.Errorf("errors = %q, want %q", got, want)
+	}
+}